@@ -0,0 +1,199 @@
+package mid
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AdaptiveLimiter is a concurrency limiter whose limit adjusts itself
+// according to the latency and failure rate of the operations it admits,
+// using the additive-increase/multiplicative-decrease (AIMD) algorithm.
+//
+// Each operation that succeeds within Target raises the limit by a small amount
+// (about one per limit's worth of operations).
+// Each operation that fails or exceeds Target lowers the limit by the factor Backoff.
+// The limit rises only while the limiter is at least half utilized,
+// so a lightly loaded limiter does not grow without bound.
+//
+// Use it on the server side with [Adaptive]
+// and on the client side with [AdaptiveTransport].
+//
+// An AdaptiveLimiter must not be copied after first use.
+type AdaptiveLimiter struct {
+	// Min and Max bound the limit.
+	// If Min is less than 1, 1 is used.
+	// If Max is zero, there is no upper bound.
+	Min, Max int
+
+	// Initial is the starting limit.
+	// If this is zero, Min is used.
+	Initial int
+
+	// Target is the latency above which an operation is treated as a sign of congestion.
+	// If this is zero, only failures lower the limit.
+	Target time.Duration
+
+	// Backoff is the factor by which the limit is multiplied on congestion.
+	// If this is not between 0 and 1, 0.9 is used.
+	Backoff float64
+
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	changed  chan struct{} // closed and replaced whenever a slot is released
+}
+
+// Limit reports the current limit.
+func (al *AdaptiveLimiter) Limit() int {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.init()
+	return int(al.limit)
+}
+
+// InFlight reports the number of operations currently admitted.
+func (al *AdaptiveLimiter) InFlight() int {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.inFlight
+}
+
+// init sets the initial limit.
+// Callers must hold al.mu.
+func (al *AdaptiveLimiter) init() {
+	if al.limit != 0 {
+		return
+	}
+	al.limit = float64(max(al.Initial, al.Min, 1))
+	if al.Max > 0 {
+		al.limit = min(al.limit, float64(al.Max))
+	}
+	al.changed = make(chan struct{})
+}
+
+// tryAcquire admits an operation if the limit allows.
+// On success it returns the operation's start time,
+// which the caller must pass to release.
+func (al *AdaptiveLimiter) tryAcquire() (time.Time, bool) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	al.init()
+	if al.inFlight >= int(al.limit) {
+		return time.Time{}, false
+	}
+	al.inFlight++
+	return now(al.Now), true
+}
+
+// acquire is like tryAcquire but waits for the limit to allow the operation.
+func (al *AdaptiveLimiter) acquire(ctx context.Context) (time.Time, error) {
+	for {
+		start, ok := al.tryAcquire()
+		if ok {
+			return start, nil
+		}
+
+		al.mu.Lock()
+		changed := al.changed
+		al.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return time.Time{}, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// release ends an operation and adjusts the limit according to its outcome.
+func (al *AdaptiveLimiter) release(start time.Time, failed bool) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	latency := now(al.Now).Sub(start)
+	if failed || (al.Target > 0 && latency > al.Target) {
+		backoff := al.Backoff
+		if backoff <= 0 || backoff >= 1 {
+			backoff = 0.9
+		}
+		al.limit = max(al.limit*backoff, float64(max(al.Min, 1)))
+	} else if 2*al.inFlight >= int(al.limit) {
+		al.limit += 1 / al.limit
+		if al.Max > 0 {
+			al.limit = min(al.limit, float64(al.Max))
+		}
+	}
+
+	al.inFlight--
+	close(al.changed)
+	al.changed = make(chan struct{})
+}
+
+// Adaptive is an [http.Handler] middleware wrapper
+// that limits the number of requests in flight using al.
+// Responses with 5xx status codes count as failures.
+// Requests arriving when the limit is reached are rejected with 503 Service Unavailable
+// (via a [CodeErr] wrapping [ErrOverloaded])
+// and a Retry-After header field.
+func Adaptive(al *AdaptiveLimiter, next http.Handler) http.Handler {
+	return Err(func(w http.ResponseWriter, req *http.Request) error {
+		start, ok := al.tryAcquire()
+		if !ok {
+			setRetryAfter(w.Header(), time.Second)
+			return CodeErr{C: http.StatusServiceUnavailable, Err: ErrOverloaded}
+		}
+
+		ww := ResponseWrapper{W: w}
+		defer func() {
+			al.release(start, ww.Result() >= 500)
+		}()
+
+		next.ServeHTTP(&ww, req)
+		return nil
+	})
+}
+
+// AdaptiveTransport is an [http.RoundTripper] that limits the number of requests it has in flight
+// using the [AdaptiveLimiter] in A.
+// When the limit is reached, requests wait for a slot
+// (or for their contexts to be canceled).
+// Errors, and responses with status 429 or 5xx, count as failures.
+// Latency is measured until the response header arrives.
+//
+// After obtaining a slot,
+// it delegates to the http.RoundTripper in T.
+// If T is nil, it uses [http.DefaultTransport].
+type AdaptiveTransport struct {
+	A *AdaptiveLimiter
+	T http.RoundTripper
+}
+
+// RoundTrip implements the [http.RoundTripper] interface.
+func (at AdaptiveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	start, err := at.A.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	next := at.T
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	resp, err := next.RoundTrip(req)
+
+	// An error caused by the caller giving up is not a sign of congestion.
+	failed := err != nil && ctx.Err() == nil
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500) {
+		failed = true
+	}
+	at.A.release(start, failed)
+
+	return resp, err
+}
@@ -0,0 +1,133 @@
+package mid
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveLimiter(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000000, 0)}
+	al := &AdaptiveLimiter{Min: 2, Max: 12, Initial: 10, Target: time.Second, Now: clock.Now}
+
+	// Fill the limiter, then let every operation succeed quickly.
+	fill := func() []time.Time {
+		var starts []time.Time
+		for {
+			start, ok := al.tryAcquire()
+			if !ok {
+				return starts
+			}
+			starts = append(starts, start)
+		}
+	}
+
+	starts := fill()
+	if len(starts) != 10 {
+		t.Fatalf("admitted %d operations, want 10", len(starts))
+	}
+	for _, start := range starts {
+		al.release(start, false)
+	}
+	if got := al.Limit(); got != 10 {
+		t.Errorf("after one round of successes, got limit %d, want 10", got)
+	}
+
+	for i := 0; i < 5; i++ {
+		for _, start := range fill() {
+			al.release(start, false)
+		}
+	}
+	if got := al.Limit(); got != 12 {
+		t.Errorf("after many successes, got limit %d, want 12", got)
+	}
+
+	// Slow operations lower the limit.
+	starts = fill()
+	clock.advance(2 * time.Second)
+	for _, start := range starts[:3] {
+		al.release(start, false)
+	}
+	if got := al.Limit(); got != 8 {
+		t.Errorf("after slow operations, got limit %d, want 8", got)
+	}
+
+	// Failures lower it to the minimum.
+	for _, start := range starts[3:] {
+		al.release(start, true)
+	}
+	for i := 0; i < 5; i++ {
+		for _, start := range fill() {
+			al.release(start, true)
+		}
+	}
+	if got := al.Limit(); got != 2 {
+		t.Errorf("after failures, got limit %d, want 2", got)
+	}
+	if got := al.InFlight(); got != 0 {
+		t.Errorf("got %d in flight, want 0", got)
+	}
+}
+
+func TestAdaptive(t *testing.T) {
+	al := &AdaptiveLimiter{Initial: 1}
+	unblock := make(chan struct{})
+	h := Adaptive(al, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/block" {
+			<-unblock
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/block", nil))
+		close(done)
+	}()
+	for al.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	close(unblock)
+	<-done
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestAdaptiveTransport(t *testing.T) {
+	al := &AdaptiveLimiter{Initial: 1}
+	at := AdaptiveTransport{A: al, T: mockTransport{}}
+
+	start, _ := al.tryAcquire()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req := (&http.Request{}).WithContext(ctx)
+	if _, err := at.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	errc := make(chan error)
+	go func() {
+		_, err := at.RoundTrip(&http.Request{})
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	al.release(start, false)
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+}
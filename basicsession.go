@@ -0,0 +1,184 @@
+package mid
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"time"
+
+	"github.com/bobg/errors"
+)
+
+// BasicSession is a concrete implementation of [Session]
+// used by the session stores in this package.
+// It is also a [DataSession].
+// It is not safe for concurrent use.
+type BasicSession struct {
+	csrfKey      [sha256.Size]byte
+	created, exp time.Time
+	canceled     bool
+	data         map[string]json.RawMessage
+	dirty        bool
+}
+
+var _ DataSession = &BasicSession{}
+
+// NewBasicSession creates a new, active session
+// with a random CSRF key
+// and the given creation and expiration times.
+func NewBasicSession(created, exp time.Time) (*BasicSession, error) {
+	s := &BasicSession{created: created, exp: exp}
+	if err := s.newCSRFKey(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newCSRFKey replaces the CSRF key of s with a new random one.
+func (s *BasicSession) newCSRFKey() error {
+	_, err := rand.Read(s.csrfKey[:])
+	return errors.Wrap(err, "generating CSRF key")
+}
+
+// CSRFKey implements [Session].
+func (s *BasicSession) CSRFKey() [sha256.Size]byte { return s.csrfKey }
+
+// Active implements [Session].
+func (s *BasicSession) Active() bool { return !s.canceled }
+
+// Exp implements [Session].
+func (s *BasicSession) Exp() time.Time { return s.exp }
+
+// Created is the creation time of the session.
+func (s *BasicSession) Created() time.Time { return s.created }
+
+// Get implements [DataSession].
+func (s *BasicSession) Get(name string, ptr any) (bool, error) {
+	val, ok := s.data[name]
+	if !ok {
+		return false, nil
+	}
+	return true, errors.Wrapf(json.Unmarshal(val, ptr), "decoding session value %s", name)
+}
+
+// Set implements [DataSession].
+func (s *BasicSession) Set(name string, val any) error {
+	j, err := json.Marshal(val)
+	if err != nil {
+		return errors.Wrapf(err, "encoding session value %s", name)
+	}
+	if s.data == nil {
+		s.data = make(map[string]json.RawMessage)
+	}
+	s.data[name] = j
+	s.dirty = true
+	return nil
+}
+
+// Delete implements [DataSession].
+func (s *BasicSession) Delete(name string) {
+	if _, ok := s.data[name]; ok {
+		delete(s.data, name)
+		s.dirty = true
+	}
+}
+
+// Dirty implements [DataSession].
+func (s *BasicSession) Dirty() bool { return s.dirty }
+
+// MarkSaved implements [DataSession].
+func (s *BasicSession) MarkSaved() { s.dirty = false }
+
+// clone returns a copy of s.
+func (s *BasicSession) clone() *BasicSession {
+	c := *s
+	c.data = maps.Clone(s.data)
+	return &c
+}
+
+type basicSessionJSON struct {
+	CSRFKey  []byte                     `json:"csrf"`
+	Created  time.Time                  `json:"created"`
+	Exp      time.Time                  `json:"exp"`
+	Canceled bool                       `json:"canceled,omitempty"`
+	Data     map[string]json.RawMessage `json:"data,omitempty"`
+}
+
+// MarshalJSON implements [json.Marshaler].
+// It allows session stores to serialize a BasicSession.
+func (s *BasicSession) MarshalJSON() ([]byte, error) {
+	return json.Marshal(basicSessionJSON{
+		CSRFKey:  s.csrfKey[:],
+		Created:  s.created,
+		Exp:      s.exp,
+		Canceled: s.canceled,
+		Data:     s.data,
+	})
+}
+
+// UnmarshalJSON implements [json.Unmarshaler].
+func (s *BasicSession) UnmarshalJSON(b []byte) error {
+	var j basicSessionJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if len(j.CSRFKey) != len(s.csrfKey) {
+		return errors.New("bad CSRF key length")
+	}
+	*s = BasicSession{
+		created:  j.Created,
+		exp:      j.Exp,
+		canceled: j.Canceled,
+		data:     j.Data,
+	}
+	copy(s.csrfKey[:], j.CSRFKey)
+	return nil
+}
+
+// NewSessionKey generates a random session key,
+// suitable for use as the value of a session cookie.
+func NewSessionKey() (string, error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", errors.Wrap(err, "generating session key")
+	}
+	return base64.RawURLEncoding.EncodeToString(buf[:]), nil
+}
+
+// hashSessionKey returns a hash of a session key,
+// for use by stores that should not keep keys in the clear.
+func hashSessionKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// maskSessionKey masks newKey with a hash of oldKey,
+// so that a store can record the new key of a rotated session under its old key
+// without keeping it in the clear.
+func maskSessionKey(oldKey, newKey string) ([]byte, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(newKey)
+	if err != nil || len(buf) != sha256.Size {
+		return nil, errors.New("malformed session key")
+	}
+	pad := sha256.Sum256([]byte(oldKey))
+	for i := range buf {
+		buf[i] ^= pad[i]
+	}
+	return buf, nil
+}
+
+// unmaskSessionKey reverses maskSessionKey.
+func unmaskSessionKey(oldKey string, masked []byte) (string, error) {
+	if len(masked) != sha256.Size {
+		return "", errors.New("malformed session alias")
+	}
+	pad := sha256.Sum256([]byte(oldKey))
+	buf := make([]byte, len(masked))
+	for i := range buf {
+		buf[i] = masked[i] ^ pad[i]
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,332 @@
+package mid
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bobg/errors"
+)
+
+// BreakerState is the state of a circuit breaker in a [BreakerTransport].
+type BreakerState int
+
+// Values for BreakerState.
+const (
+	// BreakerClosed is the normal state, in which requests are allowed.
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen is the state after too many failures, in which requests fail fast.
+	BreakerOpen
+
+	// BreakerHalfOpen is the state after the cool-down period,
+	// in which a limited number of probe requests are allowed
+	// to test whether the upstream has recovered.
+	BreakerHalfOpen
+)
+
+// String implements fmt.Stringer.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// ErrBreakerOpen is the error matched (via [errors.Is]) by the errors that [BreakerTransport] produces
+// when it rejects a request without sending it.
+var ErrBreakerOpen = errors.New("circuit breaker open")
+
+// BreakerError is the error produced by [BreakerTransport] when it rejects a request without sending it.
+// It matches [ErrBreakerOpen] with [errors.Is].
+type BreakerError struct {
+	// Key is the breaker key of the rejected request.
+	Key string
+
+	// State is the state of the breaker:
+	// BreakerOpen,
+	// or BreakerHalfOpen if the maximum number of probes is already in flight.
+	State BreakerState
+}
+
+// Error implements the error interface.
+func (e BreakerError) Error() string {
+	return fmt.Sprintf("circuit breaker %s for %s", e.State, e.Key)
+}
+
+// Is implements the interface for [errors.Is].
+func (e BreakerError) Is(target error) bool {
+	return target == ErrBreakerOpen
+}
+
+// BreakerTransport is an [http.RoundTripper] implementing the circuit-breaker pattern.
+// It keeps a separate breaker for each upstream host
+// (or each value of a custom Key function).
+//
+// A breaker starts out closed, passing requests to the http.RoundTripper in T
+// (or [http.DefaultTransport] if T is nil).
+// After too many failures it opens,
+// and requests fail fast with a [BreakerError].
+// After the cool-down period it becomes half-open,
+// allowing up to Probes requests through at a time.
+// If Probes of those succeed, the breaker closes again;
+// if any fails, the breaker reopens.
+//
+// A BreakerTransport must not be copied after first use.
+type BreakerTransport struct {
+	T http.RoundTripper
+
+	// Key, if non-nil, selects the breaker for a request.
+	// By default the request's URL host is used.
+	Key func(*http.Request) string
+
+	// Consecutive is the number of consecutive failures that opens a closed breaker.
+	// If this and FailureRate are both zero, 5 is used.
+	Consecutive int
+
+	// FailureRate, if positive, is the fraction of failed requests in a Window
+	// that opens a closed breaker,
+	// once at least MinRequests requests have completed in that window.
+	FailureRate float64
+
+	// MinRequests is the minimum number of requests in a window for FailureRate to apply.
+	// If this is zero, 10 is used.
+	MinRequests int
+
+	// Window is the interval over which a closed breaker counts failures for FailureRate.
+	// If this is zero, one minute is used.
+	Window time.Duration
+
+	// Cooldown is how long a breaker stays open before becoming half-open.
+	// If this is zero, 30 seconds is used.
+	Cooldown time.Duration
+
+	// Probes is the number of requests allowed through at a time by a half-open breaker,
+	// and the number of those that must succeed for it to close.
+	// If this is zero, 1 is used.
+	Probes int
+
+	// IsFailure, if non-nil, tells whether the result of a request counts as a failure.
+	// By default, errors and responses with 5xx status codes are failures.
+	// Errors caused by cancellation of the request's context never count as failures.
+	IsFailure func(*http.Response, error) bool
+
+	// OnStateChange, if non-nil, is called whenever a breaker changes state.
+	// It is suitable for logging and metrics.
+	OnStateChange func(key string, from, to BreakerState)
+
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+type breaker struct {
+	state BreakerState
+	gen   int // incremented on each state change
+
+	// closed-state counters
+	windowStart        time.Time
+	requests, failures int
+	consecutive        int
+
+	// open-state and half-open-state data
+	openedAt               time.Time
+	probes, probeSuccesses int
+}
+
+type breakerTransition struct {
+	key      string
+	from, to BreakerState
+}
+
+// State reports the state of the breaker for the given key.
+func (bt *BreakerTransport) State(key string) BreakerState {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	if b, ok := bt.breakers[key]; ok {
+		return b.state
+	}
+	return BreakerClosed
+}
+
+// RoundTrip implements the [http.RoundTripper] interface.
+func (bt *BreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := req.URL.Host
+	if bt.Key != nil {
+		key = bt.Key(req)
+	}
+
+	gen, probe, err := bt.allow(key)
+	if err != nil {
+		return nil, err
+	}
+
+	next := bt.T
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	resp, err := next.RoundTrip(req)
+
+	var failed, ignore bool
+	switch {
+	case req.Context().Err() != nil:
+		ignore = true
+	case bt.IsFailure != nil:
+		failed = bt.IsFailure(resp, err)
+	default:
+		failed = err != nil || resp.StatusCode >= 500
+	}
+	bt.record(key, gen, probe, failed, ignore)
+
+	return resp, err
+}
+
+func (bt *BreakerTransport) allow(key string) (gen int, probe bool, err error) {
+	bt.mu.Lock()
+	var transitions []breakerTransition
+	defer func() {
+		bt.mu.Unlock()
+		bt.notify(transitions)
+	}()
+
+	if bt.breakers == nil {
+		bt.breakers = make(map[string]*breaker)
+	}
+	b, ok := bt.breakers[key]
+	if !ok {
+		b = &breaker{}
+		bt.breakers[key] = b
+	}
+
+	t := now(bt.Now)
+
+	switch b.state {
+	case BreakerClosed:
+		if window := durationOr(bt.Window, time.Minute); !t.Before(b.windowStart.Add(window)) {
+			b.windowStart = t
+			b.requests, b.failures = 0, 0
+		}
+		return b.gen, false, nil
+
+	case BreakerOpen:
+		if t.Before(b.openedAt.Add(durationOr(bt.Cooldown, 30*time.Second))) {
+			return 0, false, BreakerError{Key: key, State: BreakerOpen}
+		}
+		transitions = append(transitions, bt.setState(key, b, BreakerHalfOpen, t))
+	}
+
+	// Half-open.
+	if b.probes >= max(bt.Probes, 1) {
+		return 0, false, BreakerError{Key: key, State: BreakerHalfOpen}
+	}
+	b.probes++
+	return b.gen, true, nil
+}
+
+func (bt *BreakerTransport) record(key string, gen int, probe, failed, ignore bool) {
+	bt.mu.Lock()
+	var transitions []breakerTransition
+	defer func() {
+		bt.mu.Unlock()
+		bt.notify(transitions)
+	}()
+
+	b := bt.breakers[key]
+	if b == nil || b.gen != gen {
+		// The breaker changed state while this request was in flight.
+		return
+	}
+
+	t := now(bt.Now)
+
+	if probe {
+		b.probes--
+		switch {
+		case ignore:
+		case failed:
+			transitions = append(transitions, bt.setState(key, b, BreakerOpen, t))
+		default:
+			b.probeSuccesses++
+			if b.probeSuccesses >= max(bt.Probes, 1) {
+				transitions = append(transitions, bt.setState(key, b, BreakerClosed, t))
+			}
+		}
+		return
+	}
+
+	if ignore {
+		return
+	}
+
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+
+	consecutive := bt.Consecutive
+	if consecutive == 0 && bt.FailureRate == 0 {
+		consecutive = 5
+	}
+	minRequests := bt.MinRequests
+	if minRequests == 0 {
+		minRequests = 10
+	}
+
+	switch {
+	case consecutive > 0 && b.consecutive >= consecutive:
+	case bt.FailureRate > 0 && b.requests >= minRequests && float64(b.failures) >= bt.FailureRate*float64(b.requests):
+	default:
+		return
+	}
+	transitions = append(transitions, bt.setState(key, b, BreakerOpen, t))
+}
+
+// setState changes the state of b.
+// Callers must hold bt.mu.
+func (bt *BreakerTransport) setState(key string, b *breaker, state BreakerState, t time.Time) breakerTransition {
+	tr := breakerTransition{key: key, from: b.state, to: state}
+
+	b.state = state
+	b.gen++
+	b.probes, b.probeSuccesses = 0, 0
+
+	switch state {
+	case BreakerOpen:
+		b.openedAt = t
+	case BreakerClosed:
+		b.windowStart = t
+		b.requests, b.failures, b.consecutive = 0, 0, 0
+	}
+
+	return tr
+}
+
+// notify calls OnStateChange for each transition.
+// Callers must not hold bt.mu.
+func (bt *BreakerTransport) notify(transitions []breakerTransition) {
+	if bt.OnStateChange == nil {
+		return
+	}
+	for _, tr := range transitions {
+		bt.OnStateChange(tr.key, tr.from, tr.to)
+	}
+}
+
+func durationOr(d, dflt time.Duration) time.Duration {
+	if d == 0 {
+		return dflt
+	}
+	return d
+}
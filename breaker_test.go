@@ -0,0 +1,124 @@
+package mid
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakerTransport(t *testing.T) {
+	var (
+		clock       = &fakeClock{t: time.Unix(1000000, 0)}
+		transitions []string
+		status      int
+		calls       int
+	)
+
+	bt := &BreakerTransport{
+		T: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+			calls++
+			return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(""))}, nil
+		}),
+		Consecutive: 2,
+		Cooldown:    10 * time.Second,
+		OnStateChange: func(key string, from, to BreakerState) {
+			transitions = append(transitions, fmt.Sprintf("%s:%s->%s", key, from, to))
+		},
+		Now: clock.Now,
+	}
+
+	cases := []struct {
+		host      string
+		advance   time.Duration
+		status    int
+		wantOpen  bool
+		wantState BreakerState
+	}{
+		{host: "a", status: 500, wantState: BreakerClosed},
+		{host: "a", status: 200, wantState: BreakerClosed},
+		{host: "a", status: 500, wantState: BreakerClosed},
+		{host: "a", status: 500, wantState: BreakerOpen},
+		{host: "a", status: 200, wantOpen: true, wantState: BreakerOpen},
+		{host: "b", status: 200, wantState: BreakerClosed},
+		{host: "a", advance: 5 * time.Second, status: 200, wantOpen: true, wantState: BreakerOpen},
+		{host: "a", advance: 5 * time.Second, status: 503, wantState: BreakerOpen},
+		{host: "a", advance: 10 * time.Second, status: 200, wantState: BreakerClosed},
+		{host: "a", status: 500, wantState: BreakerClosed},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case_%02d", i+1), func(t *testing.T) {
+			clock.advance(tc.advance)
+			status = tc.status
+			callsBefore := calls
+
+			req, err := http.NewRequest("GET", "http://"+tc.host+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = bt.RoundTrip(req)
+
+			if tc.wantOpen {
+				if !errors.Is(err, ErrBreakerOpen) {
+					t.Errorf("got error %v, want %v", err, ErrBreakerOpen)
+				}
+				var berr BreakerError
+				if !errors.As(err, &berr) || berr.Key != tc.host {
+					t.Errorf("got error %v, want BreakerError for %s", err, tc.host)
+				}
+				if calls != callsBefore {
+					t.Error("request was sent through open breaker")
+				}
+			} else if err != nil {
+				t.Errorf("got error %v, want nil", err)
+			}
+
+			if got := bt.State(tc.host); got != tc.wantState {
+				t.Errorf("got state %s, want %s", got, tc.wantState)
+			}
+		})
+	}
+
+	want := []string{"a:closed->open", "a:open->half-open", "a:half-open->open", "a:open->half-open", "a:half-open->closed"}
+	if fmt.Sprint(transitions) != fmt.Sprint(want) {
+		t.Errorf("got transitions %v, want %v", transitions, want)
+	}
+}
+
+func TestBreakerFailureRate(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000000, 0)}
+	n := 0
+	bt := &BreakerTransport{
+		T: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+			n++
+			if n%2 == 0 {
+				return nil, errors.New("connection reset")
+			}
+			return &http.Response{StatusCode: 200}, nil
+		}),
+		FailureRate: 0.5,
+		MinRequests: 4,
+		Now:         clock.Now,
+	}
+
+	for i := 0; i < 4; i++ {
+		if got := bt.State("x"); got != BreakerClosed {
+			t.Fatalf("before request %d, got state %s, want %s", i+1, got, BreakerClosed)
+		}
+		bt.RoundTrip(&http.Request{URL: &url.URL{Host: "x"}})
+	}
+	if got := bt.State("x"); got != BreakerOpen {
+		t.Errorf("got state %s, want %s", got, BreakerOpen)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,179 @@
+package mid
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bobg/errors"
+)
+
+// ConcurrencyLimiter caps the number of requests in flight at once.
+// Requests beyond the cap may wait in a bounded queue for a free slot;
+// when the queue is full, or a request waits too long,
+// the request is shed.
+// See [Concurrency].
+//
+// A ConcurrencyLimiter must not be copied after first use.
+type ConcurrencyLimiter struct {
+	// Max is the maximum number of requests in flight.
+	Max int
+
+	// Queue is the maximum number of requests waiting for a slot.
+	// If this is zero,
+	// requests arriving when Max requests are already in flight are shed immediately.
+	Queue int
+
+	// Timeout is the longest a request may wait in the queue.
+	// If this is zero,
+	// a request waits until its context is canceled.
+	Timeout time.Duration
+
+	// Priority, if non-nil, assigns a priority to each request.
+	// Queued requests with higher priorities get free slots first.
+	// Requests with equal priorities are served in arrival order.
+	Priority func(*http.Request) int
+
+	// Bypass, if non-nil, reports whether a request bypasses the limiter altogether.
+	// This is suitable for e.g. health checks.
+	Bypass func(*http.Request) bool
+
+	// RetryAfter is the value of the Retry-After field in responses to shed requests.
+	// If this is zero, one second is used.
+	RetryAfter time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+	waiters  []*concWaiter
+}
+
+type concWaiter struct {
+	prio    int
+	ready   chan struct{}
+	granted bool
+}
+
+// InFlight reports the number of requests currently holding a slot.
+func (cl *ConcurrencyLimiter) InFlight() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.inFlight
+}
+
+// Queued reports the number of requests currently waiting for a slot.
+func (cl *ConcurrencyLimiter) Queued() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return len(cl.waiters)
+}
+
+// acquire obtains a slot,
+// waiting in the queue if necessary.
+// It reports whether a slot was obtained.
+// If so, the caller must call release when done.
+func (cl *ConcurrencyLimiter) acquire(ctx context.Context, prio int) bool {
+	cl.mu.Lock()
+	if cl.inFlight < cl.Max && len(cl.waiters) == 0 {
+		cl.inFlight++
+		cl.mu.Unlock()
+		return true
+	}
+	if len(cl.waiters) >= cl.Queue {
+		cl.mu.Unlock()
+		return false
+	}
+
+	w := &concWaiter{prio: prio, ready: make(chan struct{})}
+	i := len(cl.waiters)
+	for i > 0 && cl.waiters[i-1].prio < prio {
+		i--
+	}
+	cl.waiters = append(cl.waiters, nil)
+	copy(cl.waiters[i+1:], cl.waiters[i:])
+	cl.waiters[i] = w
+	cl.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if cl.Timeout > 0 {
+		timer := time.NewTimer(cl.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-w.ready:
+		return true
+	case <-ctx.Done():
+	case <-timeout:
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if w.granted {
+		// The slot was handed over while timing out.
+		return true
+	}
+	for i, other := range cl.waiters {
+		if other == w {
+			cl.waiters = append(cl.waiters[:i], cl.waiters[i+1:]...)
+			break
+		}
+	}
+	return false
+}
+
+// release frees a slot,
+// handing it directly to the first waiter if there is one.
+func (cl *ConcurrencyLimiter) release() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if len(cl.waiters) == 0 {
+		cl.inFlight--
+		return
+	}
+	w := cl.waiters[0]
+	cl.waiters = cl.waiters[1:]
+	w.granted = true
+	close(w.ready)
+}
+
+// ErrOverloaded is the error produced when a request is shed by [Concurrency].
+var ErrOverloaded = errors.New("overloaded")
+
+// Concurrency is an [http.Handler] middleware wrapper
+// that limits the number of requests in flight using cl.
+// Requests that cannot get a slot are rejected with 503 Service Unavailable
+// (via a [CodeErr] wrapping [ErrOverloaded])
+// and a Retry-After header field.
+//
+// To apply both a global limit and per-route limits,
+// wrap the whole router in one limiter
+// and individual routes in others.
+func Concurrency(cl *ConcurrencyLimiter, next http.Handler) http.Handler {
+	return Err(func(w http.ResponseWriter, req *http.Request) error {
+		if cl.Bypass != nil && cl.Bypass(req) {
+			next.ServeHTTP(w, req)
+			return nil
+		}
+
+		var prio int
+		if cl.Priority != nil {
+			prio = cl.Priority(req)
+		}
+		if !cl.acquire(req.Context(), prio) {
+			retry := cl.RetryAfter
+			if retry == 0 {
+				retry = time.Second
+			}
+			setRetryAfter(w.Header(), retry)
+			return CodeErr{C: http.StatusServiceUnavailable, Err: ErrOverloaded}
+		}
+		defer cl.release()
+
+		next.ServeHTTP(w, req)
+		return nil
+	})
+}
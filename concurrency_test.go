@@ -0,0 +1,125 @@
+package mid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrency(t *testing.T) {
+	var (
+		unblock = make(chan struct{})
+		mu      sync.Mutex
+		order   []string
+	)
+
+	cl := &ConcurrencyLimiter{
+		Max:   1,
+		Queue: 2,
+		Priority: func(req *http.Request) int {
+			p, _ := strconv.Atoi(req.URL.Query().Get("prio"))
+			return p
+		},
+		Bypass: func(req *http.Request) bool {
+			return req.URL.Path == "/healthz"
+		},
+	}
+	h := Concurrency(cl, http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		order = append(order, req.URL.Query().Get("name"))
+		mu.Unlock()
+		if req.URL.Path != "/healthz" {
+			<-unblock
+		}
+	}))
+
+	var wg sync.WaitGroup
+	serve := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		return rec
+	}
+	serveAsync := func(url string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rec := serve(url); rec.Code != http.StatusNoContent {
+				t.Errorf("%s: got status %d, want %d", url, rec.Code, http.StatusNoContent)
+			}
+		}()
+	}
+	waitFor := func(inFlight, queued int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for cl.InFlight() != inFlight || cl.Queued() != queued {
+			if time.Now().After(deadline) {
+				t.Fatalf("got %d in flight and %d queued, want %d and %d", cl.InFlight(), cl.Queued(), inFlight, queued)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	serveAsync("/?name=a")
+	waitFor(1, 0)
+	serveAsync("/?name=b&prio=0")
+	waitFor(1, 1)
+	serveAsync("/?name=c&prio=1")
+	waitFor(1, 2)
+
+	rec := serve("/?name=d")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("got Retry-After %q, want \"1\"", got)
+	}
+
+	if rec := serve("/healthz?name=e"); rec.Code != http.StatusNoContent {
+		t.Errorf("got status %d for bypass request, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	close(unblock)
+	wg.Wait()
+	waitFor(0, 0)
+
+	want := []string{"a", "e", "c", "b"}
+	if len(order) != len(want) {
+		t.Fatalf("got order %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("got order %v, want %v", order, want)
+		}
+	}
+}
+
+func TestConcurrencyTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	cl := &ConcurrencyLimiter{Max: 1, Queue: 1, Timeout: 10 * time.Millisecond}
+	h := Concurrency(cl, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		<-unblock
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		close(done)
+	}()
+	for cl.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if got := cl.Queued(); got != 0 {
+		t.Errorf("got %d queued after timeout, want 0", got)
+	}
+
+	close(unblock)
+	<-done
+}
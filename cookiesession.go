@@ -0,0 +1,459 @@
+package mid
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/bobg/errors"
+)
+
+// CookieSessionStore is a [SessionStore] that keeps no server-side state
+// except a list of canceled sessions (see [RevocationStore]).
+// Instead, the whole session
+// (including its expiration time, CSRF key, and data)
+// is encoded in the session key,
+// i.e. the value of the session cookie.
+// The encoding is authenticated with HMAC-SHA256,
+// and optionally encrypted with AES-GCM.
+// Its sessions are of type [*BasicSession].
+//
+// Since the key encodes the session,
+// it changes whenever the session does.
+// [SessionHandler] re-issues the session cookie when that happens.
+// A session's data must be small enough to fit in a cookie;
+// Save and the other methods that encode a session
+// fail if the encoding exceeds 4096 bytes.
+//
+// Canceled sessions are remembered in Revocations until they expire.
+// By default that is a [MemRevocationStore] private to the CookieSessionStore,
+// so cancellation is not shared among the instances of a replicated service
+// and does not survive a restart.
+// Supply a shared RevocationStore
+// (e.g. one backed by a database)
+// to make it so.
+// Since a copy of any of a session's keys might have been renewed,
+// a canceled session is remembered until the end of its maximum lifetime
+// (see MaxLifetime),
+// after which none of its keys is valid.
+// Use a short session lifetime with sliding expiration (see [SessionOpts])
+// to limit the damage of a stolen cookie.
+//
+// A CookieSessionStore must not be copied after first use.
+type CookieSessionStore struct {
+	// Keys are the secret keys for authentication and encryption.
+	// The first key is used for new cookies.
+	// All keys are tried when verifying a cookie.
+	// To rotate keys, add a new key at the front of the list,
+	// and remove the oldest one after the maximum session lifetime has passed.
+	// At least one key is required.
+	// Each key should be at least 32 random bytes.
+	Keys [][]byte
+
+	// Encrypt, if true, encrypts session contents
+	// so that clients cannot read them.
+	// Otherwise they are only authenticated.
+	Encrypt bool
+
+	// MaxLifetime is the absolute maximum lifetime of a session.
+	// No session expires later than this much time after its creation,
+	// no matter how it is renewed.
+	// If this is zero, [DefaultCookieSessionMaxLifetime] is used.
+	MaxLifetime time.Duration
+
+	// Revocations records canceled sessions.
+	// If this is nil, a private [MemRevocationStore] is used.
+	Revocations RevocationStore
+
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu  sync.Mutex
+	mem *MemRevocationStore // used when Revocations is nil
+}
+
+// RevocationStore records the sessions canceled in a [CookieSessionStore],
+// by session ID.
+// (A session's ID is unchanged by renewal,
+// so canceling one of its keys cancels them all.)
+type RevocationStore interface {
+	// Revoke records that the session with the given ID is canceled as of time at.
+	// The record is needed only until exp,
+	// when the session's keys expire.
+	// If the session is already revoked,
+	// the record keeps the earlier of the two cancellation times
+	// and the later of the two expiration times.
+	Revoke(ctx context.Context, id string, at, exp time.Time) error
+
+	// Revoked returns the record for the session with the given ID,
+	// or nil if it has not been revoked.
+	Revoked(ctx context.Context, id string) (*Revocation, error)
+}
+
+// Revocation is a record in a [RevocationStore].
+type Revocation struct {
+	// At is the time as of which the session is canceled.
+	At time.Time
+
+	// Exp is when the record may be discarded.
+	Exp time.Time
+}
+
+// MemRevocationStore is an in-memory [RevocationStore].
+// Records are discarded after they expire,
+// by [MemRevocationStore.Purge]
+// and whenever a session is revoked.
+//
+// A MemRevocationStore must not be copied after first use.
+type MemRevocationStore struct {
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	revoked map[string]Revocation // session ID -> revocation
+}
+
+var _ RevocationStore = &MemRevocationStore{}
+
+// Revoke implements [RevocationStore].
+func (s *MemRevocationStore) Revoke(_ context.Context, id string, at, exp time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.revoked == nil {
+		s.revoked = make(map[string]Revocation)
+	}
+	s.purge(now(s.Now))
+	if rev, ok := s.revoked[id]; ok {
+		if rev.At.Before(at) {
+			at = rev.At
+		}
+		if rev.Exp.After(exp) {
+			exp = rev.Exp
+		}
+	}
+	s.revoked[id] = Revocation{At: at, Exp: exp}
+	return nil
+}
+
+// Revoked implements [RevocationStore].
+func (s *MemRevocationStore) Revoked(_ context.Context, id string) (*Revocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rev, ok := s.revoked[id]
+	if !ok {
+		return nil, nil
+	}
+	return &rev, nil
+}
+
+// Purge discards expired records.
+// It returns the number of records discarded.
+func (s *MemRevocationStore) Purge() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.purge(now(s.Now))
+}
+
+// purge discards records expired at time t.
+// Callers must hold s.mu.
+func (s *MemRevocationStore) purge(t time.Time) int {
+	var n int
+	for id, rev := range s.revoked {
+		if !t.Before(rev.Exp) {
+			delete(s.revoked, id)
+			n++
+		}
+	}
+	return n
+}
+
+// DefaultCookieSessionMaxLifetime is the maximum lifetime of a session
+// when none is given in [CookieSessionStore].
+const DefaultCookieSessionMaxLifetime = 30 * 24 * time.Hour
+
+type cookieSessionPayload struct {
+	ID string        `json:"id"`
+	S  *BasicSession `json:"s"`
+}
+
+const maxCookieLen = 4096
+
+var (
+	_ SessionCreator = &CookieSessionStore{}
+	_ Renewer        = &CookieSessionStore{}
+	_ Rotator        = &CookieSessionStore{}
+	_ SessionSaver   = &CookieSessionStore{}
+)
+
+// Create implements [SessionCreator].
+func (s *CookieSessionStore) Create(_ context.Context, exp time.Time) (string, Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return "", nil, err
+	}
+	sess, err := NewBasicSession(now(s.Now), exp)
+	if err != nil {
+		return "", nil, err
+	}
+	sess.exp = s.capExp(sess, exp)
+	key, err := s.encode(id, sess)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, sess, nil
+}
+
+// Get implements [SessionStore].
+// It returns [ErrNoSession] for expired sessions
+// and for keys that cannot be verified.
+func (s *CookieSessionStore) Get(ctx context.Context, key string) (Session, error) {
+	_, sess, err := s.decode(ctx, key)
+	return sess, err
+}
+
+// Cancel implements [SessionStore].
+func (s *CookieSessionStore) Cancel(ctx context.Context, key string) error {
+	id, sess, err := s.decode(ctx, key)
+	if errors.Is(err, ErrNoSession) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(s.revocations().Revoke(ctx, id, now(s.Now), s.maxExp(sess)), "revoking session")
+}
+
+// Renew implements [Renewer].
+// The key always changes.
+// The session's expiration time is limited by MaxLifetime.
+func (s *CookieSessionStore) Renew(ctx context.Context, key string, exp time.Time) (string, Session, error) {
+	id, sess, err := s.decode(ctx, key)
+	if err != nil {
+		return "", nil, err
+	}
+	sess.exp = s.capExp(sess, exp)
+	key, err = s.encode(id, sess)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, sess, nil
+}
+
+// Rotate implements [Rotator].
+// The session gets a new ID,
+// and the old ID is canceled after the grace period.
+func (s *CookieSessionStore) Rotate(ctx context.Context, oldKey string, grace time.Duration) (string, Session, error) {
+	oldID, sess, err := s.decode(ctx, oldKey)
+	if err != nil {
+		return "", nil, err
+	}
+	if !sess.Active() {
+		return "", nil, ErrNoSession
+	}
+	id, err := newSessionID()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := sess.newCSRFKey(); err != nil {
+		return "", nil, err
+	}
+	key, err := s.encode(id, sess)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := s.revocations().Revoke(ctx, oldID, now(s.Now).Add(grace), s.maxExp(sess)); err != nil {
+		return "", nil, errors.Wrap(err, "revoking old session ID")
+	}
+	return key, sess, nil
+}
+
+// Save implements [SessionSaver].
+// The session must be a [*BasicSession].
+// Only its data is saved.
+// The key always changes.
+func (s *CookieSessionStore) Save(ctx context.Context, key string, sess Session) (string, error) {
+	bs, ok := sess.(*BasicSession)
+	if !ok {
+		return "", errors.Newf("cannot save session of type %T", sess)
+	}
+	id, stored, err := s.decode(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	stored.data = bs.data
+	return s.encode(id, stored)
+}
+
+// Purge discards the records of canceled sessions that have expired
+// from the default [MemRevocationStore],
+// or from Revocations if it has a Purge method like that one.
+// It returns the number of records discarded.
+// This also happens automatically whenever a session is canceled.
+func (s *CookieSessionStore) Purge() int {
+	if p, ok := s.revocations().(interface{ Purge() int }); ok {
+		return p.Purge()
+	}
+	return 0
+}
+
+// maxExp is the latest expiration time any key for sess may have.
+func (s *CookieSessionStore) maxExp(sess *BasicSession) time.Time {
+	return sess.created.Add(durationOr(s.MaxLifetime, DefaultCookieSessionMaxLifetime))
+}
+
+// capExp limits an expiration time for sess to maxExp.
+func (s *CookieSessionStore) capExp(sess *BasicSession, exp time.Time) time.Time {
+	if maxExp := s.maxExp(sess); exp.After(maxExp) {
+		return maxExp
+	}
+	return exp
+}
+
+func (s *CookieSessionStore) revocations() RevocationStore {
+	if s.Revocations != nil {
+		return s.Revocations
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.mem == nil {
+		s.mem = &MemRevocationStore{Now: s.Now}
+	}
+	return s.mem
+}
+
+func (s *CookieSessionStore) encode(id string, sess *BasicSession) (string, error) {
+	if len(s.Keys) == 0 {
+		return "", errors.New("no keys")
+	}
+	macKey, encKey := cookieSessionKeys(s.Keys[0])
+
+	buf, err := json.Marshal(cookieSessionPayload{ID: id, S: sess})
+	if err != nil {
+		return "", errors.Wrap(err, "encoding session")
+	}
+
+	if s.Encrypt {
+		aead, err := newCookieAEAD(encKey)
+		if err != nil {
+			return "", err
+		}
+		nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(buf)+aead.Overhead()+sha256.Size)
+		if _, err := rand.Read(nonce); err != nil {
+			return "", errors.Wrap(err, "generating nonce")
+		}
+		buf = aead.Seal(nonce, nonce, buf, nil)
+	}
+
+	h := hmac.New(sha256.New, macKey)
+	h.Write(buf)
+	buf = h.Sum(buf)
+
+	key := base64.RawURLEncoding.EncodeToString(buf)
+	if len(key) > maxCookieLen {
+		return "", errors.New("session too large for cookie")
+	}
+	return key, nil
+}
+
+// decode verifies and decodes a session key.
+// It returns ErrNoSession if the key is invalid or the session has expired.
+// A canceled session is returned with its canceled flag set.
+func (s *CookieSessionStore) decode(ctx context.Context, key string) (string, *BasicSession, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil || len(buf) < sha256.Size {
+		return "", nil, ErrNoSession
+	}
+	buf, sum := buf[:len(buf)-sha256.Size], buf[len(buf)-sha256.Size:]
+
+	for _, k := range s.Keys {
+		macKey, encKey := cookieSessionKeys(k)
+		h := hmac.New(sha256.New, macKey)
+		h.Write(buf)
+		if !hmac.Equal(h.Sum(nil), sum) {
+			continue
+		}
+
+		if s.Encrypt {
+			aead, err := newCookieAEAD(encKey)
+			if err != nil {
+				return "", nil, err
+			}
+			if len(buf) < aead.NonceSize() {
+				return "", nil, ErrNoSession
+			}
+			nonce, ciphertext := buf[:aead.NonceSize()], buf[aead.NonceSize():]
+			if buf, err = aead.Open(nil, nonce, ciphertext, nil); err != nil {
+				return "", nil, ErrNoSession
+			}
+		}
+
+		var payload cookieSessionPayload
+		if err := json.Unmarshal(buf, &payload); err != nil || payload.S == nil {
+			return "", nil, ErrNoSession
+		}
+
+		t := now(s.Now)
+		if !t.Before(s.capExp(payload.S, payload.S.exp)) {
+			return "", nil, ErrNoSession
+		}
+
+		revocations := s.revocations()
+		rev, err := revocations.Revoked(ctx, payload.ID)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "checking session revocation")
+		}
+		if rev != nil && !t.Before(rev.At) {
+			payload.S.canceled = true
+			if payload.S.exp.After(rev.Exp) {
+				// Remember the cancellation as long as this key is valid.
+				if err := revocations.Revoke(ctx, payload.ID, rev.At, payload.S.exp); err != nil {
+					return "", nil, errors.Wrap(err, "extending session revocation")
+				}
+			}
+		}
+
+		return payload.ID, payload.S, nil
+	}
+
+	return "", nil, ErrNoSession
+}
+
+// cookieSessionKeys derives separate authentication and encryption keys from a secret key.
+func cookieSessionKeys(k []byte) (macKey, encKey []byte) {
+	derive := func(label string) []byte {
+		h := hmac.New(sha256.New, k)
+		h.Write([]byte(label))
+		return h.Sum(nil)
+	}
+	return derive("mid cookie session mac"), derive("mid cookie session enc")
+}
+
+func newCookieAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, errors.Wrap(err, "creating GCM")
+}
+
+// newSessionID generates a random session ID.
+func newSessionID() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", errors.Wrap(err, "generating session ID")
+	}
+	return base64.RawURLEncoding.EncodeToString(buf[:]), nil
+}
@@ -0,0 +1,274 @@
+package mid
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCookieSessionStore(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		t.Run(map[bool]string{false: "signed", true: "encrypted"}[encrypt], func(t *testing.T) {
+			var (
+				ctx   = context.Background()
+				clock = &fakeClock{t: time.Unix(1000000, 0)}
+				key1  = bytes.Repeat([]byte{1}, 32)
+				key2  = bytes.Repeat([]byte{2}, 32)
+				store = &CookieSessionStore{Keys: [][]byte{key1}, Encrypt: encrypt, Now: clock.Now}
+			)
+
+			key, s, err := store.Create(ctx, clock.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.(DataSession).Set("user", "alice-in-wonderland"); err != nil {
+				t.Fatal(err)
+			}
+			key, err = store.Save(ctx, key, s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			raw, err := base64.RawURLEncoding.DecodeString(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if readable := bytes.Contains(raw, []byte("alice-in-wonderland")); readable == encrypt {
+				t.Errorf("encrypt=%v but data readable=%v", encrypt, readable)
+			}
+
+			got, err := store.Get(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.CSRFKey() != s.CSRFKey() || !got.Exp().Equal(s.Exp()) || !got.Active() {
+				t.Errorf("got session %+v, want %+v", got, s)
+			}
+			if user, _, err := SessionValue[string](got.(DataSession), "user"); err != nil || user != "alice-in-wonderland" {
+				t.Errorf("got user %q (error %v), want alice-in-wonderland", user, err)
+			}
+
+			// Tampering is detected.
+			raw[len(raw)/2] ^= 1
+			if _, err := store.Get(ctx, base64.RawURLEncoding.EncodeToString(raw)); !errors.Is(err, ErrNoSession) {
+				t.Errorf("got error %v for tampered key, want %v", err, ErrNoSession)
+			}
+
+			// Old keys still verify after key rotation.
+			store.Keys = [][]byte{key2, key1}
+			if _, err := store.Get(ctx, key); err != nil {
+				t.Errorf("got error %v after adding a new key", err)
+			}
+			renewedKey, _, err := store.Renew(ctx, key, clock.Now().Add(2*time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.Keys = [][]byte{key2}
+			if _, err := store.Get(ctx, key); !errors.Is(err, ErrNoSession) {
+				t.Errorf("got error %v after removing the old key, want %v", err, ErrNoSession)
+			}
+			got, err = store.Get(ctx, renewedKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := clock.Now().Add(2 * time.Hour); !got.Exp().Equal(want) {
+				t.Errorf("got expiration %v, want %v", got.Exp(), want)
+			}
+			key = renewedKey
+
+			clock.advance(3 * time.Hour)
+			if _, err := store.Get(ctx, key); !errors.Is(err, ErrNoSession) {
+				t.Errorf("got error %v for expired session, want %v", err, ErrNoSession)
+			}
+		})
+	}
+}
+
+func TestCookieSessionStoreCancel(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		store = &CookieSessionStore{Keys: [][]byte{bytes.Repeat([]byte{1}, 32)}, MaxLifetime: 150 * time.Minute, Now: clock.Now}
+	)
+
+	key, _, err := store.Create(ctx, clock.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewedKey, _, err := store.Renew(ctx, key, clock.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Cancel(ctx, renewedKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Cancel(ctx, "bogus"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Canceling a session cancels all of its keys.
+	for _, k := range []string{key, renewedKey} {
+		s, err := store.Get(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Active() {
+			t.Error("canceled session is active")
+		}
+	}
+
+	clock.advance(90 * time.Minute)
+	if n := store.Purge(); n != 0 {
+		t.Errorf("purged %d records, want 0", n)
+	}
+	clock.advance(time.Hour)
+	if n := store.Purge(); n != 1 {
+		t.Errorf("purged %d records, want 1", n)
+	}
+}
+
+func TestCookieSessionStoreCancelStolenKey(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		store = &CookieSessionStore{Keys: [][]byte{bytes.Repeat([]byte{1}, 32)}, MaxLifetime: 3 * time.Hour, Now: clock.Now}
+	)
+
+	key, _, err := store.Create(ctx, clock.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An attacker renews a copy of the cookie,
+	// then the victim logs out with the original.
+	copyKey, _, err := store.Renew(ctx, key, clock.Now().Add(10*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Cancel(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.advance(90 * time.Minute)
+	store.Purge()
+	s, err := store.Get(ctx, copyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Active() {
+		t.Error("copy of canceled session is active after the original key expired")
+	}
+	if want := time.Unix(1000000, 0).Add(3 * time.Hour); !s.Exp().Equal(want) {
+		t.Errorf("got expiration %v, want %v", s.Exp(), want)
+	}
+
+	clock.advance(90 * time.Minute)
+	if n := store.Purge(); n != 1 {
+		t.Errorf("purged %d records, want 1", n)
+	}
+	if _, err := store.Get(ctx, copyKey); !errors.Is(err, ErrNoSession) {
+		t.Errorf("got error %v for copy after maximum lifetime, want %v", err, ErrNoSession)
+	}
+}
+
+func TestCookieSessionStoreSharedRevocations(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		keys  = [][]byte{bytes.Repeat([]byte{1}, 32)}
+		revs  = &MemRevocationStore{Now: clock.Now}
+
+		// Two instances of a replicated service.
+		store1 = &CookieSessionStore{Keys: keys, MaxLifetime: time.Hour, Revocations: revs, Now: clock.Now}
+		store2 = &CookieSessionStore{Keys: keys, MaxLifetime: time.Hour, Revocations: revs, Now: clock.Now}
+	)
+
+	key, _, err := store1.Create(ctx, clock.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store1.Cancel(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	s, err := store2.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Active() {
+		t.Error("session canceled in one instance is active in another")
+	}
+
+	rev, err := revs.Revoked(ctx, "bogus")
+	if err != nil || rev != nil {
+		t.Errorf("got %v, %v for unrevoked ID, want nil, nil", rev, err)
+	}
+
+	clock.advance(time.Hour)
+	if n := store2.Purge(); n != 1 {
+		t.Errorf("purged %d records, want 1", n)
+	}
+}
+
+func TestCookieSessionStoreRotate(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		store = &CookieSessionStore{Keys: [][]byte{bytes.Repeat([]byte{1}, 32)}, Now: clock.Now}
+	)
+
+	oldKey, s1, err := store.Create(ctx, clock.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, s2, err := store.Rotate(ctx, oldKey, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2.CSRFKey() == s1.CSRFKey() {
+		t.Error("CSRF key did not change")
+	}
+
+	s, err := store.Get(ctx, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Active() {
+		t.Error("old key inactive during grace period")
+	}
+
+	clock.advance(time.Minute)
+	if s, err = store.Get(ctx, oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if s.Active() {
+		t.Error("old key active after grace period")
+	}
+	if s, err = store.Get(ctx, newKey); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Active() {
+		t.Error("new key inactive")
+	}
+}
+
+func TestCookieSessionStoreTooLarge(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = &CookieSessionStore{Keys: [][]byte{bytes.Repeat([]byte{1}, 32)}}
+	)
+	key, s, err := store.Create(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.(DataSession).Set("big", strings.Repeat("x", maxCookieLen)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Save(ctx, key, s); err == nil {
+		t.Error("got no error saving oversized session")
+	}
+}
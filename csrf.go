@@ -0,0 +1,269 @@
+package mid
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bobg/errors"
+)
+
+// CSRFConfig is the configuration for [CSRFProtect].
+type CSRFConfig struct {
+	// Header is the request header field that may carry the CSRF token.
+	// If this is "", "X-CSRF-Token" is used.
+	Header string
+
+	// Field is the form field that may carry the CSRF token,
+	// if the header field is absent.
+	// If this is "", "csrf_token" is used.
+	Field string
+
+	// Exempt lists URL paths that are not protected.
+	// An entry ending in "/" exempts every path with that prefix.
+	Exempt []string
+
+	// MaxAge is the maximum age of a token.
+	// If this is zero, [DefaultCSRFMaxAge] is used.
+	MaxAge time.Duration
+
+	// BindAction, if true, requires each token to be bound to the request's method and path,
+	// i.e. generated with [CSRFTokenOpts]
+	// using an Action of CSRFAction(method, path).
+	BindAction bool
+
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// CSRFProtect is an [http.Handler] middleware wrapper
+// that checks the CSRF token (see [CSRFToken])
+// of every request with an unsafe method
+// (i.e., other than GET, HEAD, OPTIONS, and TRACE)
+// against the session in the request context.
+// It should be layered inside [SessionHandler],
+// which places the session in the context.
+//
+// The token is taken from the request header field named in conf,
+// or failing that from the form field named in conf.
+// It is checked with [CSRFCheckOpts].
+// A request with a missing or invalid token, or with no session,
+// is rejected with 403 Forbidden via a [CodeErr] wrapping [ErrCSRF].
+func CSRFProtect(conf CSRFConfig, next http.Handler) http.Handler {
+	var (
+		header = stringOr(conf.Header, "X-CSRF-Token")
+		field  = stringOr(conf.Field, "csrf_token")
+	)
+
+	return Err(func(w http.ResponseWriter, req *http.Request) error {
+		if isSafeMethod(req.Method) || conf.exempt(req.URL.Path) {
+			next.ServeHTTP(w, req)
+			return nil
+		}
+
+		s := ContextSession(req.Context())
+		if s == nil {
+			return CodeErr{C: http.StatusForbidden, Err: fmt.Errorf("%w: no session", ErrCSRF)}
+		}
+
+		token := csrfRequestToken(req, header, field)
+		if token == "" {
+			return CodeErr{C: http.StatusForbidden, Err: fmt.Errorf("%w: no token", ErrCSRF)}
+		}
+
+		opts := CSRFOpts{MaxAge: conf.MaxAge, Now: conf.Now}
+		if conf.BindAction {
+			opts.Action = CSRFAction(req.Method, req.URL.Path)
+		}
+		if err := CSRFCheckOpts(s, token, opts); err != nil {
+			if !errors.Is(err, ErrCSRF) {
+				err = fmt.Errorf("%w: %w", ErrCSRF, err)
+			}
+			return CodeErr{C: http.StatusForbidden, Err: err}
+		}
+
+		next.ServeHTTP(w, req)
+		return nil
+	})
+}
+
+// csrfRequestToken gets the CSRF token from the given header field of req,
+// or failing that from the given form field.
+func csrfRequestToken(req *http.Request, header, field string) string {
+	if token := req.Header.Get(header); token != "" {
+		return token
+	}
+	return req.PostFormValue(field)
+}
+
+func (conf CSRFConfig) exempt(path string) bool {
+	for _, e := range conf.Exempt {
+		if e == path || (strings.HasSuffix(e, "/") && strings.HasPrefix(path, e)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSafeMethod tells whether an HTTP method is "safe" in the sense of RFC 9110,
+// i.e. is not expected to change the state of the server.
+func isSafeMethod(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// DoubleSubmit provides CSRF protection for requests that have no [Session],
+// such as the submission of a login or signup form,
+// using the double-submit-cookie pattern.
+//
+// [DoubleSubmit.Token] sets a cookie containing a signed random ID
+// and returns a CSRF token derived from it,
+// to be included in the page (e.g. in a form field).
+// [DoubleSubmit.Check] verifies that a request carries both the cookie
+// and a matching token.
+// A cross-site attacker can cause the browser to send the cookie,
+// but cannot read it or produce a matching token.
+// Tokens are generated and checked like those of [CSRFToken] and [CSRFCheck],
+// with a CSRF key derived from Secret and the cookie's ID in place of a session's.
+type DoubleSubmit struct {
+	// Secret is the server secret for signing cookies and deriving CSRF keys.
+	// It should be at least 32 random bytes.
+	Secret []byte
+
+	// Cookie describes the cookie.
+	// If its Name is "", "csrf" is used.
+	Cookie CookieOpts
+
+	// Header is the request header field that may carry the CSRF token.
+	// If this is "", "X-CSRF-Token" is used.
+	Header string
+
+	// Field is the form field that may carry the CSRF token,
+	// if the header field is absent.
+	// If this is "", "csrf_token" is used.
+	Field string
+
+	// MaxAge is the maximum age of a token.
+	// If this is zero, [DefaultCSRFMaxAge] is used.
+	MaxAge time.Duration
+
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// Token returns a CSRF token for the client making req.
+// It sets the cookie in the response if the request does not already have a valid one,
+// so it must be called before anything is written to w.
+func (d DoubleSubmit) Token(w http.ResponseWriter, req *http.Request) (string, error) {
+	id, ok := d.cookieID(req)
+	if !ok {
+		var buf [16]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			return "", errors.Wrap(err, "generating random ID")
+		}
+		id = base64.RawURLEncoding.EncodeToString(buf[:])
+		http.SetCookie(w, d.cookieOpts().cookie(id+"."+d.sign(id)))
+	}
+	return CSRFTokenOpts(d.session(id), CSRFOpts{Now: d.Now})
+}
+
+// Check checks that req carries a valid cookie and a matching CSRF token,
+// returning an error wrapping [ErrCSRF] if not.
+func (d DoubleSubmit) Check(req *http.Request) error {
+	id, ok := d.cookieID(req)
+	if !ok {
+		return fmt.Errorf("%w: missing or invalid cookie", ErrCSRF)
+	}
+	token := csrfRequestToken(req, stringOr(d.Header, "X-CSRF-Token"), stringOr(d.Field, "csrf_token"))
+	if token == "" {
+		return fmt.Errorf("%w: no token", ErrCSRF)
+	}
+	err := CSRFCheckOpts(d.session(id), token, CSRFOpts{MaxAge: d.MaxAge, Now: d.Now})
+	if err != nil && !errors.Is(err, ErrCSRF) {
+		err = fmt.Errorf("%w: %w", ErrCSRF, err)
+	}
+	return err
+}
+
+// Protect is an [http.Handler] middleware wrapper
+// that rejects requests with unsafe methods
+// (i.e., other than GET, HEAD, OPTIONS, and TRACE)
+// that do not pass [DoubleSubmit.Check].
+// Such requests get a 403 Forbidden response via a [CodeErr] wrapping [ErrCSRF].
+func (d DoubleSubmit) Protect(next http.Handler) http.Handler {
+	return Err(func(w http.ResponseWriter, req *http.Request) error {
+		if !isSafeMethod(req.Method) {
+			if err := d.Check(req); err != nil {
+				return CodeErr{C: http.StatusForbidden, Err: err}
+			}
+		}
+		next.ServeHTTP(w, req)
+		return nil
+	})
+}
+
+func (d DoubleSubmit) cookieOpts() CookieOpts {
+	opts := d.Cookie
+	if opts.Name == "" {
+		opts.Name = "csrf"
+	}
+	return opts
+}
+
+// cookieID returns the ID from the request's cookie,
+// if it has one with a valid signature.
+func (d DoubleSubmit) cookieID(req *http.Request) (string, bool) {
+	cookie, err := req.Cookie(d.cookieOpts().Name)
+	if err != nil {
+		return "", false
+	}
+	id, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(d.sign(id))) {
+		return "", false
+	}
+	return id, true
+}
+
+func (d DoubleSubmit) sign(id string) string {
+	h := hmac.New(sha256.New, d.Secret)
+	h.Write([]byte("mid double-submit cookie\x00"))
+	h.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// session returns the pseudo-session whose CSRF key is derived from Secret and the given cookie ID.
+func (d DoubleSubmit) session(id string) doubleSubmitSession {
+	h := hmac.New(sha256.New, d.Secret)
+	h.Write([]byte("mid double-submit key\x00"))
+	h.Write([]byte(id))
+
+	var s doubleSubmitSession
+	copy(s.csrfKey[:], h.Sum(nil))
+	s.exp = now(d.Now).Add(time.Hour) // never expired as far as CSRFCheckOpts is concerned
+	return s
+}
+
+// doubleSubmitSession is the always-active pseudo-session used by [DoubleSubmit].
+type doubleSubmitSession struct {
+	csrfKey [sha256.Size]byte
+	exp     time.Time
+}
+
+func (s doubleSubmitSession) CSRFKey() [sha256.Size]byte { return s.csrfKey }
+func (doubleSubmitSession) Active() bool                 { return true }
+func (s doubleSubmitSession) Exp() time.Time             { return s.exp }
+
+func stringOr(s, dflt string) string {
+	if s == "" {
+		return dflt
+	}
+	return s
+}
@@ -0,0 +1,187 @@
+package mid
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = &MemSessionStore{}
+	)
+	key, s, err := store.Create(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := CSRFToken(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		conf = CSRFConfig{Exempt: []string{"/webhook", "/api/public/"}}
+		ok   = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+		h    = SessionHandler(store, "session", CSRFProtect(conf, ok))
+	)
+
+	cases := []struct {
+		name, method, path, header, form string
+		want                             int
+	}{{
+		name: "safe method", method: "GET", path: "/", want: http.StatusNoContent,
+	}, {
+		name: "no token", method: "POST", path: "/", want: http.StatusForbidden,
+	}, {
+		name: "header", method: "POST", path: "/", header: tok, want: http.StatusNoContent,
+	}, {
+		name: "form", method: "POST", path: "/", form: tok, want: http.StatusNoContent,
+	}, {
+		name: "bad token", method: "DELETE", path: "/", header: tok[1:], want: http.StatusForbidden,
+	}, {
+		name: "exempt", method: "POST", path: "/webhook", want: http.StatusNoContent,
+	}, {
+		name: "not exempt", method: "POST", path: "/webhook/x", want: http.StatusForbidden,
+	}, {
+		name: "exempt prefix", method: "PUT", path: "/api/public/x", want: http.StatusNoContent,
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var body *strings.Reader
+			if tc.form != "" {
+				body = strings.NewReader(url.Values{"csrf_token": {tc.form}}.Encode())
+			} else {
+				body = strings.NewReader("")
+			}
+			req := httptest.NewRequest(tc.method, tc.path, body)
+			if tc.form != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if tc.header != "" {
+				req.Header.Set("X-CSRF-Token", tc.header)
+			}
+			req.AddCookie(&http.Cookie{Name: "session", Value: key})
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("got status %d, want %d", rec.Code, tc.want)
+			}
+		})
+	}
+
+	// Without a session in the context, unsafe requests are rejected.
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("X-CSRF-Token", tok)
+	rec := httptest.NewRecorder()
+	CSRFProtect(conf, ok).ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d without session, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestCSRFProtectBindAction(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = &MemSessionStore{}
+	)
+	key, s, err := store.Create(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := CSRFTokenOpts(s, CSRFOpts{Action: CSRFAction("POST", "/transfer")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := SessionHandler(store, "session", CSRFProtect(CSRFConfig{BindAction: true}, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/transfer", http.StatusNoContent},
+		{"/delete", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("POST", tc.path, nil)
+		req.Header.Set("X-CSRF-Token", tok)
+		req.AddCookie(&http.Cookie{Name: "session", Value: key})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.path, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestDoubleSubmit(t *testing.T) {
+	d := DoubleSubmit{Secret: []byte("0123456789abcdef0123456789abcdef")}
+
+	rec := httptest.NewRecorder()
+	tok, err := d.Token(rec, httptest.NewRequest("GET", "/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "csrf" || !cookies[0].HttpOnly {
+		t.Fatalf("got cookies %v, want one csrf cookie", cookies)
+	}
+	cookie := cookies[0]
+
+	// A request that already has the cookie reuses it.
+	req := httptest.NewRequest("GET", "/login", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	tok2, err := d.Token(rec, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Result().Cookies()) != 0 {
+		t.Error("cookie reissued")
+	}
+
+	h := d.Protect(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	other := DoubleSubmit{Secret: []byte("fedcba9876543210fedcba9876543210")}
+	otherRec := httptest.NewRecorder()
+	otherTok, err := other.Token(otherRec, httptest.NewRequest("GET", "/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := otherRec.Result().Cookies()[0]
+
+	for _, tc := range []struct {
+		name   string
+		cookie *http.Cookie
+		token  string
+		want   int
+	}{
+		{name: "valid", cookie: cookie, token: tok, want: http.StatusNoContent},
+		{name: "valid reused cookie", cookie: cookie, token: tok2, want: http.StatusNoContent},
+		{name: "no cookie", token: tok, want: http.StatusForbidden},
+		{name: "no token", cookie: cookie, want: http.StatusForbidden},
+		{name: "mismatched", cookie: forged, token: tok, want: http.StatusForbidden},
+		{name: "forged", cookie: forged, token: otherTok, want: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/login", nil)
+			if tc.cookie != nil {
+				req.AddCookie(tc.cookie)
+			}
+			if tc.token != "" {
+				req.Header.Set("X-CSRF-Token", tc.token)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("got status %d, want %d", rec.Code, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package mid
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bobg/errors"
+)
+
+// Deadline is an [http.Handler] middleware wrapper
+// that propagates a caller's deadline into the request context.
+// It reads the timeout from the Request-Timeout header field
+// (a number of seconds, possibly fractional)
+// and from the Grpc-Timeout field
+// (an integer followed by one of the units H, M, S, m, u, or n, as in gRPC).
+// If both are present, the smaller is used.
+// Malformed values are ignored,
+// as are values too large to represent as a [time.Duration].
+//
+// See [DeadlineTransport] for the client side.
+func Deadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		timeout, ok := requestTimeout(req.Header)
+		if !ok {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+
+		req = req.WithContext(ctx)
+		next.ServeHTTP(w, req)
+	})
+}
+
+func requestTimeout(h http.Header) (time.Duration, bool) {
+	var (
+		timeout time.Duration
+		found   bool
+	)
+
+	if val := strings.TrimSpace(h.Get("Request-Timeout")); val != "" {
+		if secs, err := strconv.ParseFloat(val, 64); err == nil && secs >= 0 && secs < math.MaxInt64/float64(time.Second) {
+			timeout, found = seconds(secs), true
+		}
+	}
+
+	if d, ok := parseGRPCTimeout(strings.TrimSpace(h.Get("Grpc-Timeout"))); ok && (!found || d < timeout) {
+		timeout, found = d, true
+	}
+
+	return timeout, found
+}
+
+var grpcUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+func parseGRPCTimeout(val string) (time.Duration, bool) {
+	if len(val) < 2 || len(val) > 9 {
+		return 0, false
+	}
+	unit, ok := grpcUnits[val[len(val)-1]]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(val[:len(val)-1], 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+func formatGRPCTimeout(d time.Duration) string {
+	// The value may have at most 8 digits.
+	for _, u := range []struct {
+		unit   time.Duration
+		suffix string
+	}{{time.Nanosecond, "n"}, {time.Microsecond, "u"}, {time.Millisecond, "m"}, {time.Second, "S"}, {time.Minute, "M"}} {
+		if n := d / u.unit; n < 1e8 {
+			return strconv.FormatInt(int64(n), 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(min(d/time.Hour, 1e8-1)), 10) + "H"
+}
+
+// DeadlineTransport is an [http.RoundTripper] that tells the server about the deadline of the request context.
+// It writes the time remaining until the deadline, less Margin,
+// into the Request-Timeout header field of outgoing requests,
+// and also into the Grpc-Timeout field if GRPC is true.
+// Requests whose contexts have no deadline are sent unchanged.
+// Requests with no time remaining fail with an error wrapping [context.DeadlineExceeded]
+// without being sent.
+//
+// After setting the header,
+// it delegates to the http.RoundTripper in T.
+// If T is nil, it uses [http.DefaultTransport].
+//
+// See [Deadline] for the server side.
+type DeadlineTransport struct {
+	// Margin is subtracted from the remaining time
+	// to allow for network latency and the caller's own processing of the response.
+	Margin time.Duration
+
+	GRPC bool
+	T    http.RoundTripper
+}
+
+// RoundTrip implements the [http.RoundTripper] interface.
+func (dt DeadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := dt.T
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	ctx := req.Context()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return next.RoundTrip(req)
+	}
+
+	remaining := time.Until(deadline) - dt.Margin
+	if remaining <= 0 {
+		return nil, errors.Wrap(context.DeadlineExceeded, "no time remaining for request")
+	}
+
+	req = req.Clone(ctx)
+	req.Header.Set("Request-Timeout", strconv.FormatFloat(remaining.Seconds(), 'f', 3, 64))
+	if dt.GRPC {
+		req.Header.Set("Grpc-Timeout", formatGRPCTimeout(remaining))
+	}
+	return next.RoundTrip(req)
+}
@@ -0,0 +1,156 @@
+package mid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeadline(t *testing.T) {
+	cases := []struct {
+		requestTimeout, grpcTimeout string
+		want                        time.Duration // zero means no deadline
+	}{{
+		want: 0,
+	}, {
+		requestTimeout: "1.5",
+		want:           1500 * time.Millisecond,
+	}, {
+		grpcTimeout: "250m",
+		want:        250 * time.Millisecond,
+	}, {
+		requestTimeout: "2",
+		grpcTimeout:    "1S",
+		want:           time.Second,
+	}, {
+		requestTimeout: "bogus",
+		grpcTimeout:    "3x",
+		want:           0,
+	}}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case_%02d", i+1), func(t *testing.T) {
+			var (
+				got   time.Duration
+				start = time.Now()
+			)
+			h := Deadline(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+				if deadline, ok := req.Context().Deadline(); ok {
+					got = deadline.Sub(start)
+				}
+			}))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if tc.requestTimeout != "" {
+				req.Header.Set("Request-Timeout", tc.requestTimeout)
+			}
+			if tc.grpcTimeout != "" {
+				req.Header.Set("Grpc-Timeout", tc.grpcTimeout)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if tc.want == 0 {
+				if got != 0 {
+					t.Errorf("got deadline in %s, want none", got)
+				}
+				return
+			}
+			if got < tc.want || got > tc.want+100*time.Millisecond {
+				t.Errorf("got deadline in %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeadlineTransport(t *testing.T) {
+	var got http.Header
+	dt := DeadlineTransport{
+		Margin: 500 * time.Millisecond,
+		GRPC:   true,
+		T: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			got = req.Header
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dt.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if got.Get("Request-Timeout") != "" {
+		t.Errorf("got Request-Timeout %q without deadline", got.Get("Request-Timeout"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := dt.RoundTrip(req.WithContext(ctx)); err != nil {
+		t.Fatal(err)
+	}
+	timeout, ok := requestTimeout(got)
+	if !ok || timeout > 9500*time.Millisecond || timeout < 9*time.Second {
+		t.Errorf("got timeout %s (Request-Timeout %q, Grpc-Timeout %q), want about 9.5s", timeout, got.Get("Request-Timeout"), got.Get("Grpc-Timeout"))
+	}
+	if req.Header.Get("Request-Timeout") != "" {
+		t.Error("original request was modified")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := dt.RoundTrip(req.WithContext(ctx)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestGRPCTimeout(t *testing.T) {
+	for _, d := range []time.Duration{0, time.Nanosecond, 1500 * time.Millisecond, 3 * time.Hour, 1000000 * time.Hour} {
+		s := formatGRPCTimeout(d)
+		got, ok := parseGRPCTimeout(s)
+		if !ok {
+			t.Errorf("%s: could not parse %q", d, s)
+			continue
+		}
+		if got > d || (d < 100000*time.Hour && d-got > d/1e7) {
+			t.Errorf("%s: formatted as %q, parsed as %s", d, s, got)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	cases := []struct {
+		requestTimeout, grpcTimeout string
+		want                        time.Duration
+		wantOK                      bool
+	}{
+		{requestTimeout: "1.5", want: 1500 * time.Millisecond, wantOK: true},
+		{grpcTimeout: "3S", want: 3 * time.Second, wantOK: true},
+		{requestTimeout: "5", grpcTimeout: "2S", want: 2 * time.Second, wantOK: true},
+		{requestTimeout: "-1"},
+		{requestTimeout: "NaN"},
+		{requestTimeout: "Inf"},
+		{requestTimeout: "1e12"},
+		{requestTimeout: "1e300"},
+		{grpcTimeout: "99999999H"},
+		{grpcTimeout: "-1S"},
+		{requestTimeout: "1e300", grpcTimeout: "1S", want: time.Second, wantOK: true},
+	}
+	for _, tc := range cases {
+		h := http.Header{}
+		if tc.requestTimeout != "" {
+			h.Set("Request-Timeout", tc.requestTimeout)
+		}
+		if tc.grpcTimeout != "" {
+			h.Set("Grpc-Timeout", tc.grpcTimeout)
+		}
+		got, ok := requestTimeout(h)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("Request-Timeout %q, Grpc-Timeout %q: got %s, %v, want %s, %v", tc.requestTimeout, tc.grpcTimeout, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package mid
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bobg/errors"
+)
+
+// FileSessionStore is a [SessionStore] that keeps sessions in files in a directory,
+// so that they survive restarts.
+// Its sessions are of type [*BasicSession].
+//
+// Each session is stored in its own file,
+// named for a hash of the session key
+// (so that keys cannot be learned from the directory listing).
+// Files are replaced atomically,
+// and on Unix systems access is serialized with a lock file,
+// making the store safe for use by multiple processes sharing the directory.
+// On other systems it is safe for concurrent use only within a single process.
+//
+// Expired and canceled sessions are discarded by [FileSessionStore.Purge]
+// (see also [FileSessionStore.Sweep]).
+type FileSessionStore struct {
+	// Dir is the directory holding the session files.
+	// It is created if necessary.
+	Dir string
+
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu sync.Mutex
+}
+
+// fileSessionRecord is the content of a session file.
+// It holds either a session,
+// or (for the old key of a rotated session)
+// the session's new key, its CSRF key from before rotation,
+// and the time until which the old key may be used.
+// The new key is masked with a hash of the old key,
+// so that it cannot be learned from the file alone.
+type fileSessionRecord struct {
+	S     *BasicSession `json:"s,omitempty"`
+	Alias []byte        `json:"alias,omitempty"`
+	CSRF  []byte        `json:"csrf,omitempty"`
+	Until time.Time     `json:"until,omitempty"`
+}
+
+const fileSessionSuffix = ".session"
+
+var (
+	_ SessionCreator = &FileSessionStore{}
+	_ Renewer        = &FileSessionStore{}
+	_ Rotator        = &FileSessionStore{}
+	_ SessionSaver   = &FileSessionStore{}
+)
+
+// Create implements [SessionCreator].
+func (s *FileSessionStore) Create(_ context.Context, exp time.Time) (string, Session, error) {
+	key, err := NewSessionKey()
+	if err != nil {
+		return "", nil, err
+	}
+	sess, err := NewBasicSession(now(s.Now), exp)
+	if err != nil {
+		return "", nil, err
+	}
+	err = s.withLock(true, func() error {
+		return s.write(fileSessionName(key), fileSessionRecord{S: sess})
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return key, sess, nil
+}
+
+// Get implements [SessionStore].
+// It returns [ErrNoSession] for expired sessions.
+// For the old key of a rotated session,
+// the session has the CSRF key from before rotation
+// (see [Rotator]).
+func (s *FileSessionStore) Get(_ context.Context, key string) (Session, error) {
+	var sess *BasicSession
+	err := s.withLock(false, func() error {
+		var (
+			oldCSRFKey []byte
+			err        error
+		)
+		_, sess, oldCSRFKey, err = s.resolve(key)
+		if err != nil {
+			return err
+		}
+		if len(oldCSRFKey) == len(sess.csrfKey) {
+			copy(sess.csrfKey[:], oldCSRFKey)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// Cancel implements [SessionStore].
+func (s *FileSessionStore) Cancel(_ context.Context, key string) error {
+	return s.withLock(true, func() error {
+		key, sess, _, err := s.resolve(key)
+		if errors.Is(err, ErrNoSession) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		sess.canceled = true
+		return s.write(fileSessionName(key), fileSessionRecord{S: sess})
+	})
+}
+
+// Renew implements [Renewer].
+// The key does not change,
+// unless the given key is the old key of a rotated session
+// (see [FileSessionStore.Rotate]),
+// in which case the new key is returned.
+func (s *FileSessionStore) Renew(_ context.Context, key string, exp time.Time) (string, Session, error) {
+	var sess *BasicSession
+	err := s.withLock(true, func() error {
+		var err error
+		key, sess, _, err = s.resolve(key)
+		if err != nil {
+			return err
+		}
+		sess.exp = exp
+		return s.write(fileSessionName(key), fileSessionRecord{S: sess})
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return key, sess, nil
+}
+
+// Rotate implements [Rotator].
+func (s *FileSessionStore) Rotate(_ context.Context, oldKey string, grace time.Duration) (string, Session, error) {
+	newKey, err := NewSessionKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var sess *BasicSession
+	err = s.withLock(true, func() error {
+		var err error
+		oldKey, sess, _, err = s.resolve(oldKey)
+		if err != nil {
+			return err
+		}
+		oldCSRFKey := sess.csrfKey
+		if err := sess.newCSRFKey(); err != nil {
+			return err
+		}
+		if err := s.write(fileSessionName(newKey), fileSessionRecord{S: sess}); err != nil {
+			return err
+		}
+		if grace <= 0 {
+			return s.remove(fileSessionName(oldKey))
+		}
+		alias, err := maskSessionKey(oldKey, newKey)
+		if err != nil {
+			return err
+		}
+		return s.write(fileSessionName(oldKey), fileSessionRecord{Alias: alias, CSRF: oldCSRFKey[:], Until: now(s.Now).Add(grace)})
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return newKey, sess, nil
+}
+
+// Save implements [SessionSaver].
+// The session must be a [*BasicSession].
+// Only its data is saved.
+func (s *FileSessionStore) Save(_ context.Context, key string, sess Session) (string, error) {
+	bs, ok := sess.(*BasicSession)
+	if !ok {
+		return "", errors.Newf("cannot save session of type %T", sess)
+	}
+	err := s.withLock(true, func() error {
+		var (
+			stored *BasicSession
+			err    error
+		)
+		key, stored, _, err = s.resolve(key)
+		if err != nil {
+			return err
+		}
+		stored.data = bs.data
+		return s.write(fileSessionName(key), fileSessionRecord{S: stored})
+	})
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// Purge discards expired and canceled sessions,
+// and the expired old keys of rotated sessions.
+// Files that cannot be decoded are removed too.
+// Files that cannot be read or removed are skipped,
+// and the errors are returned after the rest have been processed.
+// Purge returns the number of sessions discarded.
+func (s *FileSessionStore) Purge() (int, error) {
+	var (
+		n    int
+		errs []error
+	)
+	err := s.withLock(true, func() error {
+		entries, err := os.ReadDir(s.Dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading session directory")
+		}
+
+		t := now(s.Now)
+
+		for _, entry := range entries {
+			name := entry.Name()
+			if !strings.HasSuffix(name, fileSessionSuffix) {
+				continue
+			}
+			buf, err := s.readFile(name)
+			if errors.Is(err, ErrNoSession) {
+				continue
+			}
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if rec, err := decodeFileSession(name, buf); err == nil {
+				switch {
+				case rec.S != nil:
+					if !rec.S.canceled && t.Before(rec.S.exp) {
+						continue
+					}
+					n++
+				case t.Before(rec.Until):
+					continue
+				}
+			}
+			if err := s.remove(name); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, errors.Join(errs...)
+}
+
+// Sweep calls Purge every interval until the context is canceled,
+// logging any errors.
+// It is meant to be run in its own goroutine.
+func (s *FileSessionStore) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Purge(); err != nil {
+				log.Printf("purging sessions: %s", err)
+			}
+		}
+	}
+}
+
+// resolve finds the unexpired session for a key,
+// following the alias for a rotated session's old key.
+// It returns the session's current key and the session,
+// plus, if key is such an old key,
+// the session's CSRF key from before rotation.
+// Callers must hold the lock.
+func (s *FileSessionStore) resolve(key string) (string, *BasicSession, []byte, error) {
+	t := now(s.Now)
+
+	rec, err := s.read(fileSessionName(key))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var oldCSRFKey []byte
+	if rec.S == nil {
+		if !t.Before(rec.Until) {
+			return "", nil, nil, ErrNoSession
+		}
+		if key, err = unmaskSessionKey(key, rec.Alias); err != nil {
+			return "", nil, nil, err
+		}
+		oldCSRFKey = rec.CSRF
+		if rec, err = s.read(fileSessionName(key)); err != nil {
+			return "", nil, nil, err
+		}
+	}
+	if rec.S == nil || !t.Before(rec.S.exp) {
+		return "", nil, nil, ErrNoSession
+	}
+	return key, rec.S, oldCSRFKey, nil
+}
+
+func (s *FileSessionStore) read(name string) (fileSessionRecord, error) {
+	buf, err := s.readFile(name)
+	if err != nil {
+		return fileSessionRecord{}, err
+	}
+	return decodeFileSession(name, buf)
+}
+
+func (s *FileSessionStore) readFile(name string) ([]byte, error) {
+	buf, err := os.ReadFile(filepath.Join(s.Dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNoSession
+	}
+	return buf, errors.Wrap(err, "reading session file")
+}
+
+func decodeFileSession(name string, buf []byte) (fileSessionRecord, error) {
+	var rec fileSessionRecord
+	return rec, errors.Wrapf(json.Unmarshal(buf, &rec), "decoding session file %s", name)
+}
+
+// write atomically replaces the named file.
+func (s *FileSessionStore) write(name string, rec fileSessionRecord) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "encoding session")
+	}
+	f, err := os.CreateTemp(s.Dir, ".tmp-*")
+	if err != nil {
+		return errors.Wrap(err, "creating temp file")
+	}
+	defer os.Remove(f.Name()) // no-op after a successful rename
+
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return errors.Wrap(err, "writing temp file")
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "syncing temp file")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "closing temp file")
+	}
+	return errors.Wrap(os.Rename(f.Name(), filepath.Join(s.Dir, name)), "renaming temp file")
+}
+
+func (s *FileSessionStore) remove(name string) error {
+	err := os.Remove(filepath.Join(s.Dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return errors.Wrap(err, "removing session file")
+}
+
+// withLock calls f while holding the store's in-process mutex
+// and its lock file,
+// exclusively or shared.
+func (s *FileSessionStore) withLock(exclusive bool, f func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return errors.Wrap(err, "creating session directory")
+	}
+	lf, err := os.OpenFile(filepath.Join(s.Dir, ".lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "opening lock file")
+	}
+	defer lf.Close()
+
+	if err := lockFile(lf, exclusive); err != nil {
+		return errors.Wrap(err, "locking session directory")
+	}
+	defer unlockFile(lf)
+
+	return f()
+}
+
+// fileSessionName is the name of the file for the session with the given key.
+func fileSessionName(key string) string {
+	return hashSessionKey(key) + fileSessionSuffix
+}
@@ -0,0 +1,211 @@
+package mid
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileSessionStore(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		dir   = t.TempDir()
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		store = &FileSessionStore{Dir: dir, Now: clock.Now}
+	)
+
+	key1, s1, err := store.Create(ctx, clock.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, _, err := store.Create(ctx, clock.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.(DataSession).Set("user", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Save(ctx, key1, s1); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Cancel(ctx, key2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sessions survive a restart.
+	store = &FileSessionStore{Dir: dir, Now: clock.Now}
+
+	got, err := store.Get(ctx, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CSRFKey() != s1.CSRFKey() || !got.Exp().Equal(s1.Exp()) || !got.Active() {
+		t.Errorf("got session %+v, want %+v", got, s1)
+	}
+	if user, _, err := SessionValue[string](got.(DataSession), "user"); err != nil || user != "alice" {
+		t.Errorf("got user %q (error %v), want alice", user, err)
+	}
+	if got, err = store.Get(ctx, key2); err != nil {
+		t.Fatal(err)
+	}
+	if got.Active() {
+		t.Error("canceled session is active")
+	}
+	if _, err := store.Get(ctx, "bogus"); !errors.Is(err, ErrNoSession) {
+		t.Errorf("got error %v, want %v", err, ErrNoSession)
+	}
+
+	if _, _, err := store.Renew(ctx, key1, clock.Now().Add(3*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(90 * time.Minute)
+	if _, err := store.Get(ctx, key1); err != nil {
+		t.Errorf("got error %v for renewed session", err)
+	}
+
+	if n, err := store.Purge(); err != nil || n != 1 {
+		t.Errorf("got %d, %v from Purge, want 1, nil", n, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			t.Errorf("temp file %s left behind", entry.Name())
+		}
+		if strings.Contains(entry.Name(), key1) {
+			t.Errorf("session key appears in file name %s", entry.Name())
+		}
+	}
+}
+
+func TestFileSessionStoreRotate(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		store = &FileSessionStore{Dir: t.TempDir(), Now: clock.Now}
+	)
+
+	oldKey, s1, err := store.Create(ctx, clock.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, s2, err := store.Rotate(ctx, oldKey, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKey == oldKey || s2.CSRFKey() == s1.CSRFKey() {
+		t.Fatal("session key or CSRF key did not change")
+	}
+
+	got, err := store.Get(ctx, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Exp().Equal(s2.Exp()) || got.CSRFKey() != s1.CSRFKey() {
+		t.Error("old key does not refer to rotated session with its old CSRF key")
+	}
+	key, _, err := store.Renew(ctx, oldKey, clock.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != newKey {
+		t.Error("renewing with the old key did not return the new key")
+	}
+
+	clock.advance(time.Minute)
+	if _, err := store.Get(ctx, oldKey); !errors.Is(err, ErrNoSession) {
+		t.Errorf("got error %v for old key after grace period, want %v", err, ErrNoSession)
+	}
+	if n, err := store.Purge(); err != nil || n != 0 {
+		t.Errorf("got %d, %v from Purge, want 0, nil", n, err)
+	}
+	if _, err := store.Get(ctx, newKey); err != nil {
+		t.Errorf("got error %v for new key", err)
+	}
+}
+
+func TestFileSessionStoreConcurrency(t *testing.T) {
+	var (
+		ctx = context.Background()
+		dir = t.TempDir()
+	)
+
+	key, _, err := (&FileSessionStore{Dir: dir}).Create(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Separate stores on the same directory stand in for separate processes.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store := &FileSessionStore{Dir: dir}
+			for j := 0; j < 10; j++ {
+				s, err := store.Get(ctx, key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := s.(DataSession).Set("n", i*100+j); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := store.Save(ctx, key, s); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s, err := (&FileSessionStore{Dir: dir}).Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := SessionValue[int](s.(DataSession), "n"); err != nil || !ok {
+		t.Errorf("got %v, %v reading value, want true, nil", ok, err)
+	}
+}
+
+func TestFileSessionStorePurgeBadFiles(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		dir   = t.TempDir()
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		store = &FileSessionStore{Dir: dir, Now: clock.Now}
+	)
+
+	if _, _, err := store.Create(ctx, clock.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := filepath.Join(dir, "corrupt"+fileSessionSuffix)
+	if err := os.WriteFile(corrupt, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "unreadable"+fileSessionSuffix), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.advance(2 * time.Hour)
+	n, err := store.Purge()
+	if err == nil {
+		t.Error("got no error for unreadable file")
+	}
+	if n != 1 {
+		t.Errorf("purged %d sessions, want 1", n)
+	}
+	if _, err := os.Stat(corrupt); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got error %v for corrupt file, want %v", err, os.ErrNotExist)
+	}
+}
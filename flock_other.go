@@ -0,0 +1,12 @@
+//go:build !unix
+
+package mid
+
+import "os"
+
+// On systems without flock,
+// FileSessionStore relies on its in-process mutex alone.
+
+func lockFile(*os.File, bool) error { return nil }
+
+func unlockFile(*os.File) error { return nil }
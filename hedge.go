@@ -0,0 +1,219 @@
+package mid
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HedgeTransport is an [http.RoundTripper] that reduces tail latency by hedging:
+// when a request has not produced a response after a delay,
+// it sends a duplicate,
+// returns whichever response arrives first,
+// and cancels the others.
+// Requests are delegated to the http.RoundTripper in T.
+// If T is nil, it uses [http.DefaultTransport].
+// Setting T to a [LimitedTransport] subjects hedged requests to the rate limit too.
+//
+// Only idempotent requests are hedged
+// (see [RetryTransport] for the definition).
+// A request with a body is hedged only if its GetBody field is set.
+//
+// A HedgeTransport must not be copied after first use.
+type HedgeTransport struct {
+	T http.RoundTripper
+
+	// Delay is how long to wait for a response before sending a hedged request.
+	// It is also used while too few latencies have been observed for Percentile.
+	// If no delay is available, requests are not hedged.
+	Delay time.Duration
+
+	// Percentile, if between 0 and 1,
+	// sets the hedging delay to this percentile of recently observed latencies.
+	// For example, 0.95 hedges requests that take longer than 95% of others.
+	Percentile float64
+
+	// MaxHedges is the maximum number of hedged requests sent for each original request.
+	// If this is zero, 1 is used.
+	MaxHedges int
+
+	// Budget caps the extra load from hedging
+	// as a fraction of the number of original requests.
+	// If this is zero, 0.1 is used.
+	Budget float64
+
+	mu      sync.Mutex
+	samples []time.Duration // ring buffer of recent latencies
+	next    int             // next index in samples to overwrite
+	tokens  float64         // hedging budget
+}
+
+const (
+	hedgeSamples    = 100
+	hedgeMinSamples = 10
+	hedgeMaxTokens  = 10
+)
+
+type hedgeResult struct {
+	resp    *http.Response
+	err     error
+	idx     int
+	latency time.Duration
+}
+
+// RoundTrip implements the [http.RoundTripper] interface.
+func (ht *HedgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := ht.T
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if !isIdempotent(req) || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		return next.RoundTrip(req)
+	}
+
+	delay := ht.begin()
+	if delay <= 0 {
+		return next.RoundTrip(req)
+	}
+
+	var (
+		ctx     = req.Context()
+		results = make(chan hedgeResult, 1+max(ht.MaxHedges, 1))
+		cancels []context.CancelFunc
+	)
+
+	launch := func() error {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		attemptReq := req.Clone(attemptCtx)
+		if len(cancels) > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				cancel()
+				return err
+			}
+			attemptReq.Body = body
+		}
+		idx := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			start := time.Now()
+			resp, err := next.RoundTrip(attemptReq)
+			results <- hedgeResult{resp: resp, err: err, idx: idx, latency: time.Since(start)}
+		}()
+		return nil
+	}
+
+	if err := launch(); err != nil {
+		return nil, err
+	}
+
+	var (
+		inFlight = 1
+		hedges   int
+		timer    = time.NewTimer(delay)
+		lastErr  error
+	)
+	defer timer.Stop()
+
+	for inFlight > 0 {
+		select {
+		case res := <-results:
+			inFlight--
+			if res.err != nil {
+				cancels[res.idx]()
+				lastErr = res.err
+				continue
+			}
+			ht.observe(res.latency)
+			for i, cancel := range cancels {
+				if i != res.idx {
+					cancel()
+				}
+			}
+			go drainHedges(results, inFlight)
+			res.resp.Body = cancelBody{ReadCloser: res.resp.Body, cancel: cancels[res.idx]}
+			return res.resp, nil
+
+		case <-timer.C:
+			if hedges < max(ht.MaxHedges, 1) && ht.spend() {
+				if err := launch(); err == nil {
+					inFlight++
+					hedges++
+				}
+				timer.Reset(delay)
+			}
+		}
+	}
+
+	return nil, lastErr
+}
+
+// begin adds to the hedging budget for a new request
+// and returns the hedging delay to use.
+func (ht *HedgeTransport) begin() time.Duration {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+
+	budget := ht.Budget
+	if budget == 0 {
+		budget = 0.1
+	}
+	ht.tokens = min(ht.tokens+budget, hedgeMaxTokens)
+
+	if ht.Percentile > 0 && ht.Percentile < 1 && len(ht.samples) >= hedgeMinSamples {
+		sorted := append([]time.Duration(nil), ht.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		return sorted[int(ht.Percentile*float64(len(sorted)-1))]
+	}
+	return ht.Delay
+}
+
+// spend takes one hedged request's worth from the budget if possible.
+func (ht *HedgeTransport) spend() bool {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+
+	if ht.tokens < 1 {
+		return false
+	}
+	ht.tokens--
+	return true
+}
+
+func (ht *HedgeTransport) observe(latency time.Duration) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+
+	if len(ht.samples) < hedgeSamples {
+		ht.samples = append(ht.samples, latency)
+		return
+	}
+	ht.samples[ht.next] = latency
+	ht.next = (ht.next + 1) % hedgeSamples
+}
+
+// drainHedges receives the results of the n (already canceled) losing requests,
+// closing any response bodies.
+func drainHedges(results <-chan hedgeResult, n int) {
+	for i := 0; i < n; i++ {
+		res := <-results
+		if res.resp != nil {
+			res.resp.Body.Close()
+		}
+	}
+}
+
+// cancelBody is a response body that cancels its request's context when closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (cb cancelBody) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.cancel()
+	return err
+}
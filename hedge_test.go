@@ -0,0 +1,121 @@
+package mid
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHedgeTransport(t *testing.T) {
+	cases := []struct {
+		name       string
+		method     string
+		budget     float64
+		wantCalls  int
+		wantWinner string
+	}{{
+		name:       "hedged",
+		method:     "GET",
+		budget:     1,
+		wantCalls:  2,
+		wantWinner: "2",
+	}, {
+		name:       "not_idempotent",
+		method:     "POST",
+		budget:     1,
+		wantCalls:  1,
+		wantWinner: "1",
+	}, {
+		name:       "over_budget",
+		method:     "GET",
+		budget:     0.5,
+		wantCalls:  1,
+		wantWinner: "1",
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			st := &slowFirstTransport{}
+			ht := &HedgeTransport{T: st, Delay: 10 * time.Millisecond, Budget: tc.budget}
+
+			req, err := http.NewRequest(tc.method, "http://example.com/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := ht.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if string(body) != tc.wantWinner {
+				t.Errorf("got response from attempt %s, want %s", body, tc.wantWinner)
+			}
+
+			st.wg.Wait()
+			if st.calls != tc.wantCalls {
+				t.Errorf("got %d calls, want %d", st.calls, tc.wantCalls)
+			}
+			if tc.wantCalls > 1 && !st.firstCanceled {
+				t.Error("losing request was not canceled")
+			}
+		})
+	}
+}
+
+func TestHedgePercentile(t *testing.T) {
+	ht := &HedgeTransport{Delay: time.Second, Percentile: 0.9}
+	for i := 1; i <= hedgeMinSamples; i++ {
+		if got := ht.begin(); got != time.Second {
+			t.Fatalf("with %d samples, got delay %s, want %s", i-1, got, time.Second)
+		}
+		ht.observe(time.Duration(i) * time.Millisecond)
+	}
+	if got := ht.begin(); got != 9*time.Millisecond {
+		t.Errorf("got delay %s, want %s", got, 9*time.Millisecond)
+	}
+}
+
+// slowFirstTransport is an http.RoundTripper whose first call is slow
+// and whose subsequent calls are fast.
+// Each response body is the number of the call that produced it.
+type slowFirstTransport struct {
+	wg            sync.WaitGroup
+	mu            sync.Mutex
+	calls         int
+	firstCanceled bool
+}
+
+func (st *slowFirstTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	st.wg.Add(1)
+	defer st.wg.Done()
+
+	st.mu.Lock()
+	st.calls++
+	n := st.calls
+	st.mu.Unlock()
+
+	if n == 1 {
+		select {
+		case <-req.Context().Done():
+			st.mu.Lock()
+			st.firstCanceled = true
+			st.mu.Unlock()
+			return nil, req.Context().Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(strconv.Itoa(n))),
+	}, nil
+}
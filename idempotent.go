@@ -0,0 +1,303 @@
+package mid
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bobg/errors"
+)
+
+// IdempotencyRecord is what an [IdempotencyStore] keeps for an idempotency key.
+type IdempotencyRecord struct {
+	// Fingerprint identifies the request that first used the key.
+	Fingerprint [sha256.Size]byte
+
+	// Done is false while that request is still being handled.
+	Done bool
+
+	// Code, Header, and Body are the recorded response.
+	// They are meaningful only when Done is true.
+	Code   int
+	Header http.Header
+	Body   []byte
+}
+
+// IdempotencyStore is storage for the responses recorded by [Idempotent].
+type IdempotencyStore interface {
+	// Claim atomically creates an in-flight record for the given key with the given fingerprint,
+	// if there is not already an unexpired record for that key.
+	// It returns the existing record if there is one,
+	// and nil otherwise.
+	Claim(ctx context.Context, key string, fingerprint [sha256.Size]byte) (*IdempotencyRecord, error)
+
+	// Complete stores the finished record for a key previously claimed.
+	Complete(ctx context.Context, key string, rec *IdempotencyRecord) error
+
+	// Release deletes the record for a key previously claimed,
+	// so that a later request with the same key is handled anew.
+	Release(ctx context.Context, key string) error
+}
+
+// Idempotent is an [http.Handler] middleware wrapper
+// that makes requests carrying an Idempotency-Key (or X-Idempotency-Key) header field
+// safe to retry.
+// (Compare [Trace], which uses the same fields as trace IDs.)
+// Requests without such a field are passed through unchanged.
+//
+// The first request with a given key is handled normally,
+// and its response (status code, header, and body) is recorded in store.
+// A later request with the same key and the same method, URL path and query, and body
+// gets a replay of the recorded response.
+// A later request with the same key but a different method, path, query, or body
+// is rejected with 422 Unprocessable Entity,
+// and one arriving while the first is still in flight
+// is rejected with 409 Conflict.
+//
+// Responses with 5xx status codes are not recorded,
+// so that a request that fails that way may be retried.
+//
+// Keys are shared by all clients,
+// and request bodies are limited to [DefaultIdempotentMaxBody].
+// Use [IdempotentOpts] to change that.
+func Idempotent(store IdempotencyStore, next http.Handler) http.Handler {
+	return IdempotentOpts(store, IdempotencyOpts{}, next)
+}
+
+// DefaultIdempotentMaxBody is the default limit on the size of request bodies
+// handled by [Idempotent].
+const DefaultIdempotentMaxBody = 1 << 20
+
+// IdempotencyOpts are options for [IdempotentOpts].
+type IdempotencyOpts struct {
+	// Scope, if non-nil, produces a value that qualifies the idempotency key of a request,
+	// so that different clients using the same key do not collide,
+	// and one client cannot obtain another's recorded response.
+	// [RemoteIPKey], [HeaderKey], and [SessionKey] are suitable.
+	Scope func(*http.Request) string
+
+	// MaxBody is the largest request body that is read
+	// (in order to fingerprint it).
+	// Larger requests with idempotency keys are rejected with 413 Request Entity Too Large.
+	// If this is zero, [DefaultIdempotentMaxBody] is used.
+	MaxBody int64
+}
+
+// IdempotentOpts is like [Idempotent] but takes an [IdempotencyOpts].
+func IdempotentOpts(store IdempotencyStore, opts IdempotencyOpts, next http.Handler) http.Handler {
+	maxBody := opts.MaxBody
+	if maxBody == 0 {
+		maxBody = DefaultIdempotentMaxBody
+	}
+
+	return Err(func(w http.ResponseWriter, req *http.Request) error {
+		key := idempotencyKey(req)
+		if key == "" {
+			next.ServeHTTP(w, req)
+			return nil
+		}
+		if opts.Scope != nil {
+			key = opts.Scope(req) + "\x00" + key
+		}
+
+		ctx := req.Context()
+
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxBody+1))
+		if err != nil {
+			return errors.Wrap(err, "reading request body")
+		}
+		if int64(len(body)) > maxBody {
+			return CodeErr{C: http.StatusRequestEntityTooLarge}
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		h := sha256.New()
+		h.Write([]byte(req.Method))
+		h.Write([]byte{0})
+		h.Write([]byte(req.URL.RequestURI()))
+		h.Write([]byte{0})
+		h.Write(body)
+		var fingerprint [sha256.Size]byte
+		copy(fingerprint[:], h.Sum(nil))
+
+		rec, err := store.Claim(ctx, key, fingerprint)
+		if err != nil {
+			return errors.Wrap(err, "claiming idempotency key")
+		}
+		if rec != nil {
+			switch {
+			case !rec.Done:
+				return CodeErr{C: http.StatusConflict, Err: errors.New("request with this idempotency key is in progress")}
+			case rec.Fingerprint != fingerprint:
+				return CodeErr{C: http.StatusUnprocessableEntity, Err: errors.New("idempotency key reused for a different request")}
+			}
+			dst := w.Header()
+			for k, v := range rec.Header {
+				dst[k] = v
+			}
+			w.WriteHeader(rec.Code)
+			_, err = w.Write(rec.Body)
+			return errors.Wrap(err, "replaying response")
+		}
+
+		rw := &recordingWriter{ResponseWrapper: ResponseWrapper{W: w}}
+
+		defer func() {
+			if p := recover(); p != nil {
+				store.Release(ctx, key)
+				panic(p)
+			}
+		}()
+
+		next.ServeHTTP(rw, req)
+
+		code := rw.Result()
+		if code >= 500 {
+			return errors.Wrap(store.Release(ctx, key), "releasing idempotency key")
+		}
+		rec = &IdempotencyRecord{
+			Fingerprint: fingerprint,
+			Done:        true,
+			Code:        code,
+			Header:      rw.header,
+			Body:        rw.body.Bytes(),
+		}
+		return errors.Wrap(store.Complete(ctx, key, rec), "storing response")
+	})
+}
+
+func idempotencyKey(req *http.Request) string {
+	for _, field := range []string{"Idempotency-Key", "X-Idempotency-Key"} {
+		if key := strings.TrimSpace(req.Header.Get(field)); key != "" {
+			return key
+		}
+	}
+	return ""
+}
+
+// recordingWriter is a ResponseWrapper that also keeps a copy of the response header and body.
+type recordingWriter struct {
+	ResponseWrapper
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(code int) {
+	if rw.header == nil {
+		rw.header = rw.Header().Clone()
+	}
+	rw.ResponseWrapper.WriteHeader(code)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.header == nil {
+		rw.header = rw.Header().Clone()
+	}
+	n, err := rw.ResponseWrapper.Write(b)
+	rw.body.Write(b[:n])
+	return n, err
+}
+
+// MemIdempotencyStore is an in-memory [IdempotencyStore].
+// Records expire after TTL.
+// Expired records are discarded by [MemIdempotencyStore.Purge],
+// which Claim calls at most once per TTL.
+//
+// A MemIdempotencyStore must not be copied after first use.
+type MemIdempotencyStore struct {
+	// TTL is how long records are kept.
+	// If this is zero, 24 hours is used.
+	TTL time.Duration
+
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu        sync.Mutex
+	records   map[string]memIdempotencyRecord
+	nextPurge time.Time
+}
+
+type memIdempotencyRecord struct {
+	rec *IdempotencyRecord
+	exp time.Time
+}
+
+var _ IdempotencyStore = &MemIdempotencyStore{}
+
+// Claim implements [IdempotencyStore].
+func (s *MemIdempotencyStore) Claim(_ context.Context, key string, fingerprint [sha256.Size]byte) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		t   = now(s.Now)
+		ttl = durationOr(s.TTL, 24*time.Hour)
+	)
+
+	if !t.Before(s.nextPurge) {
+		s.purge(t)
+		s.nextPurge = t.Add(ttl)
+	}
+
+	if r, ok := s.records[key]; ok && t.Before(r.exp) {
+		return r.rec, nil
+	}
+	if s.records == nil {
+		s.records = make(map[string]memIdempotencyRecord)
+	}
+	s.records[key] = memIdempotencyRecord{
+		rec: &IdempotencyRecord{Fingerprint: fingerprint},
+		exp: t.Add(ttl),
+	}
+	return nil, nil
+}
+
+// Complete implements [IdempotencyStore].
+func (s *MemIdempotencyStore) Complete(_ context.Context, key string, rec *IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.records[key]
+	if !ok {
+		return errors.New("idempotency key not claimed")
+	}
+	r.rec = rec
+	s.records[key] = r
+	return nil
+}
+
+// Release implements [IdempotencyStore].
+func (s *MemIdempotencyStore) Release(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	return nil
+}
+
+// Purge discards expired records.
+// It returns the number of records discarded.
+func (s *MemIdempotencyStore) Purge() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.purge(now(s.Now))
+}
+
+// purge discards records expired at time t.
+// Callers must hold s.mu.
+func (s *MemIdempotencyStore) purge(t time.Time) int {
+	var n int
+	for key, r := range s.records {
+		if !t.Before(r.exp) {
+			delete(s.records, key)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,175 @@
+package mid
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotent(t *testing.T) {
+	var (
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		store = &MemIdempotencyStore{TTL: time.Hour, Now: clock.Now}
+		calls int
+	)
+
+	h := Idempotent(store, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Call", strconv.Itoa(calls))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, calls)
+	}))
+
+	// Simulate a request with key "c" that is still in flight.
+	if _, err := store.Claim(context.Background(), "c", [sha256.Size]byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path, key, body string
+		advance         time.Duration
+		wantStatus      int
+		wantBody        string
+		wantCalls       int
+	}{{
+		key:        "a",
+		body:       "x",
+		wantStatus: http.StatusCreated,
+		wantBody:   "1",
+		wantCalls:  1,
+	}, {
+		key:        "a",
+		body:       "x",
+		wantStatus: http.StatusCreated,
+		wantBody:   "1",
+		wantCalls:  1,
+	}, {
+		key:        "a",
+		body:       "y",
+		wantStatus: http.StatusUnprocessableEntity,
+		wantCalls:  1,
+	}, {
+		path:       "/other",
+		key:        "a",
+		body:       "x",
+		wantStatus: http.StatusUnprocessableEntity,
+		wantCalls:  1,
+	}, {
+		path:       "/?amount=5000",
+		key:        "a",
+		body:       "x",
+		wantStatus: http.StatusUnprocessableEntity,
+		wantCalls:  1,
+	}, {
+		body:       "x",
+		wantStatus: http.StatusCreated,
+		wantBody:   "2",
+		wantCalls:  2,
+	}, {
+		path:       "/fail",
+		key:        "b",
+		wantStatus: http.StatusInternalServerError,
+		wantCalls:  3,
+	}, {
+		path:       "/fail",
+		key:        "b",
+		wantStatus: http.StatusInternalServerError,
+		wantCalls:  4,
+	}, {
+		key:        "c",
+		wantStatus: http.StatusConflict,
+		wantCalls:  4,
+	}, {
+		key:        "a",
+		body:       "x",
+		advance:    2 * time.Hour,
+		wantStatus: http.StatusCreated,
+		wantBody:   "5",
+		wantCalls:  5,
+	}}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case_%02d", i+1), func(t *testing.T) {
+			clock.advance(tc.advance)
+
+			path := tc.path
+			if path == "" {
+				path = "/"
+			}
+			req := httptest.NewRequest("POST", path, strings.NewReader(tc.body))
+			if tc.key != "" {
+				req.Header.Set("Idempotency-Key", tc.key)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tc.wantStatus)
+			}
+			if tc.wantBody != "" {
+				if got := rec.Body.String(); got != tc.wantBody {
+					t.Errorf("got body %q, want %q", got, tc.wantBody)
+				}
+				if got := rec.Header().Get("X-Call"); got != tc.wantBody {
+					t.Errorf("got X-Call %q, want %q", got, tc.wantBody)
+				}
+			}
+			if calls != tc.wantCalls {
+				t.Errorf("got %d calls, want %d", calls, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestIdempotentOpts(t *testing.T) {
+	var (
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		store = &MemIdempotencyStore{TTL: time.Hour, Now: clock.Now}
+		calls int
+	)
+
+	h := IdempotentOpts(store, IdempotencyOpts{Scope: RemoteIPKey, MaxBody: 4}, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls++
+		fmt.Fprint(w, calls)
+	}))
+
+	cases := []struct {
+		remoteAddr, body string
+		wantStatus       int
+		wantBody         string
+	}{
+		{remoteAddr: "10.0.0.1:1234", body: "x", wantStatus: http.StatusOK, wantBody: "1"},
+		{remoteAddr: "10.0.0.1:5678", body: "x", wantStatus: http.StatusOK, wantBody: "1"},
+		{remoteAddr: "10.0.0.2:1234", body: "x", wantStatus: http.StatusOK, wantBody: "2"},
+		{remoteAddr: "10.0.0.3:1234", body: "xxxxx", wantStatus: http.StatusRequestEntityTooLarge},
+	}
+	for i, tc := range cases {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(tc.body))
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Set("Idempotency-Key", "k")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != tc.wantStatus {
+			t.Errorf("case %d: got status %d, want %d", i+1, rec.Code, tc.wantStatus)
+		}
+		if tc.wantBody != "" && rec.Body.String() != tc.wantBody {
+			t.Errorf("case %d: got body %q, want %q", i+1, rec.Body.String(), tc.wantBody)
+		}
+	}
+
+	clock.advance(2 * time.Hour)
+	if n := store.Purge(); n != 2 {
+		t.Errorf("purged %d records, want 2", n)
+	}
+}
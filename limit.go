@@ -2,13 +2,21 @@ package mid
 
 import (
 	"context"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bobg/errors"
 )
 
 // Limiter is the type of an object that can be used to limit the rate of some operation.
 // Calling Wait on a Limiter blocks until the operation is allowed to proceed.
 //
-// This interface is satisfied by the *Limiter type in golang.org/x/time/rate.
+// This interface is satisfied by the *Limiter type in golang.org/x/time/rate,
+// and by the [TokenBucket], [FixedWindow], [SlidingWindowLog], and [GCRA] types in this package.
 type Limiter interface {
 	Wait(context.Context) error
 }
@@ -16,19 +24,227 @@ type Limiter interface {
 // LimitedTransport is an [http.RoundTripper] that limits the rate of requests it makes using a [Limiter].
 // After waiting for the limiter in L, it delegates to the http.RoundTripper in T.
 // If T is nil, it uses [http.DefaultTransport].
+//
+// If R is non-nil,
+// requests additionally wait for it,
+// and it observes each response,
+// so that the transport adapts its pace to the rate limits reported by upstream servers.
 type LimitedTransport struct {
 	L Limiter
 	T http.RoundTripper
+	R *RemoteLimit
 }
 
 // RoundTrip implements the [http.RoundTripper] interface.
 func (lt LimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if err := lt.L.Wait(req.Context()); err != nil {
-		return nil, err
+	ctx := req.Context()
+	if lt.R != nil {
+		if err := lt.R.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if lt.L != nil {
+		if err := lt.L.Wait(ctx); err != nil {
+			return nil, err
+		}
 	}
 	next := lt.T
 	if next == nil {
 		next = http.DefaultTransport
 	}
-	return next.RoundTrip(req)
+	resp, err := next.RoundTrip(req)
+	if lt.R != nil && resp != nil {
+		lt.R.Observe(resp)
+	}
+	return resp, err
+}
+
+// RemoteLimit is a [Limiter] that paces requests according to rate-limit information
+// reported in the responses of an upstream server.
+// It understands the Retry-After header field
+// and the RateLimit-Remaining and RateLimit-Reset fields
+// described in the IETF draft "RateLimit header fields for HTTP."
+//
+// When the server reports no remaining quota,
+// or supplies Retry-After,
+// Wait blocks until the indicated time.
+// Otherwise, when the server reports some remaining quota,
+// Wait spaces requests evenly over the time until the quota resets.
+//
+// A RemoteLimit is normally used as the R field of a [LimitedTransport].
+// It is safe for concurrent use
+// and must not be copied after first use.
+type RemoteLimit struct {
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	until    time.Time
+	interval time.Duration
+	last     time.Time
+}
+
+// Wait implements [Limiter].
+func (rl *RemoteLimit) Wait(ctx context.Context) error {
+	rl.mu.Lock()
+	t := now(rl.Now)
+	next := rl.last.Add(rl.interval)
+	if next.Before(rl.until) {
+		next = rl.until
+	}
+	if next.Before(t) {
+		next = t
+	}
+	if deadline, ok := ctx.Deadline(); ok && next.After(deadline) {
+		// Don't reserve a slot for a wait that won't happen.
+		rl.mu.Unlock()
+		return errors.Wrap(context.DeadlineExceeded, "rate limit wait would exceed context deadline")
+	}
+	rl.last = next
+	rl.mu.Unlock()
+
+	d := next.Sub(t)
+	if d <= 0 {
+		return nil
+	}
+	return sleepCtx(ctx, d)
+}
+
+// Observe updates the limit from the header of a response.
+func (rl *RemoteLimit) Observe(resp *http.Response) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	t := now(rl.Now)
+
+	if d, ok := retryAfter(resp.Header, t); ok {
+		rl.until = t.Add(d)
+		rl.interval = 0
+		return
+	}
+
+	remaining, err1 := strconv.Atoi(strings.TrimSpace(resp.Header.Get("RateLimit-Remaining")))
+	reset, err2 := strconv.ParseInt(strings.TrimSpace(resp.Header.Get("RateLimit-Reset")), 10, 64)
+	if err1 != nil || err2 != nil || remaining < 0 || reset < 0 {
+		rl.interval = 0
+		return
+	}
+	resetDur := time.Duration(reset) * time.Second
+	if remaining == 0 {
+		rl.until = t.Add(resetDur)
+		rl.interval = 0
+		return
+	}
+	rl.interval = resetDur / time.Duration(remaining)
+}
+
+// retryAfter parses the Retry-After field of h,
+// which may be a number of seconds or an HTTP date.
+func retryAfter(h http.Header, t time.Time) (time.Duration, bool) {
+	val := strings.TrimSpace(h.Get("Retry-After"))
+	if val == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(val, 10, 64); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		if secs > math.MaxInt64/int64(time.Second) {
+			return math.MaxInt64, true
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	date, err := http.ParseTime(val)
+	if err != nil {
+		return 0, false
+	}
+	return max(date.Sub(t), 0), true
+}
+
+func setRetryAfter(h http.Header, d time.Duration) {
+	h.Set("Retry-After", strconv.FormatInt(ceilSeconds(d), 10))
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64((max(d, 0) + time.Second - 1) / time.Second)
+}
+
+// KeyedTransport is an [http.RoundTripper] that limits the rate of requests it makes
+// using a separate [Limiter] for each of many keys,
+// such as upstream hosts with different quotas.
+// After waiting for the limiter for a request's key,
+// it delegates to the http.RoundTripper in T.
+// If T is nil, it uses [http.DefaultTransport].
+//
+// Limiters are created lazily, the first time their keys are seen,
+// and discarded when idle for too long or when there are too many.
+//
+// A KeyedTransport must not be copied after first use.
+type KeyedTransport struct {
+	// Key, if non-nil, selects the limiter key for a request.
+	// If nil, [HostKey] is used.
+	// See also [HostPathKey].
+	Key func(*http.Request) string
+
+	// New creates the limiter for a key.
+	New func(key string) Limiter
+
+	// Idle, if positive, is how long a limiter may go unused before it is discarded.
+	Idle time.Duration
+
+	// Size, if positive, is the maximum number of limiters to keep.
+	// When this is exceeded,
+	// the least recently used limiter is discarded.
+	Size int
+
+	T http.RoundTripper
+
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu    sync.Mutex
+	cache *lruCache[string, Limiter]
+}
+
+// RoundTrip implements the [http.RoundTripper] interface.
+func (kt *KeyedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	keyFn := kt.Key
+	if keyFn == nil {
+		keyFn = HostKey
+	}
+	lt := LimitedTransport{L: kt.Limiter(keyFn(req)), T: kt.T}
+	return lt.RoundTrip(req)
+}
+
+// Limiter returns the limiter for the given key,
+// creating it if necessary.
+func (kt *KeyedTransport) Limiter(key string) Limiter {
+	kt.mu.Lock()
+	defer kt.mu.Unlock()
+
+	if kt.cache == nil {
+		kt.cache = &lruCache[string, Limiter]{size: kt.Size, idle: kt.Idle}
+	}
+	return kt.cache.get(key, now(kt.Now), func() Limiter { return kt.New(key) })
+}
+
+// HostKey is a key function for [KeyedTransport] that produces the host (and port, if any) of the request URL.
+func HostKey(req *http.Request) string {
+	return req.URL.Host
+}
+
+// HostPathKey produces a key function for [KeyedTransport]
+// that combines the host of the request URL
+// with the longest of the given prefixes matching the URL path.
+// If no prefix matches, the key is the host alone.
+func HostPathKey(prefixes ...string) func(*http.Request) string {
+	return func(req *http.Request) string {
+		var best string
+		for _, prefix := range prefixes {
+			if len(prefix) > len(best) && strings.HasPrefix(req.URL.Path, prefix) {
+				best = prefix
+			}
+		}
+		return req.URL.Host + best
+	}
 }
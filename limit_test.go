@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 )
 
 func TestLimiter(t *testing.T) {
@@ -65,3 +66,152 @@ type mockTransport struct {
 func (mt mockTransport) RoundTrip(*http.Request) (*http.Response, error) {
 	return nil, mt.rtErr
 }
+
+func TestRemoteLimit(t *testing.T) {
+	cases := []struct {
+		header http.Header
+		want   []time.Duration
+	}{{
+		header: http.Header{},
+		want:   []time.Duration{0, 0},
+	}, {
+		header: http.Header{"Retry-After": {"30"}},
+		want:   []time.Duration{30 * time.Second, 30 * time.Second},
+	}, {
+		header: http.Header{"Retry-After": {"Sun, 06 Nov 1994 08:49:47 GMT"}},
+		want:   []time.Duration{10 * time.Second, 10 * time.Second},
+	}, {
+		header: http.Header{"Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {"20"}},
+		want:   []time.Duration{20 * time.Second, 20 * time.Second},
+	}, {
+		header: http.Header{"Ratelimit-Remaining": {"4"}, "Ratelimit-Reset": {"20"}},
+		want:   []time.Duration{0, 5 * time.Second, 10 * time.Second},
+	}}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case_%02d", i+1), func(t *testing.T) {
+			start, _ := http.ParseTime("Sun, 06 Nov 1994 08:49:37 GMT")
+			clock := &fakeClock{t: start}
+			rl := &RemoteLimit{Now: clock.Now}
+			rl.Observe(&http.Response{Header: tc.header})
+
+			// Use an already-canceled context so that Wait reports,
+			// via its error, whether it would have slept.
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			for j, want := range tc.want {
+				err := rl.Wait(ctx)
+				if (want > 0) != (err != nil) {
+					t.Errorf("wait %d: got error %v, want delay %s", j+1, err, want)
+				}
+				if got := rl.last.Sub(clock.Now()); got != want {
+					t.Errorf("wait %d: got delay %s, want %s", j+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLimitedTransportRemote(t *testing.T) {
+	transp := headerTransport{"Retry-After": {"3600"}}
+	lt := LimitedTransport{T: transp, R: &RemoteLimit{}}
+
+	if _, err := lt.RoundTrip(&http.Request{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req := (&http.Request{}).WithContext(ctx)
+	if _, err := lt.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+type headerTransport http.Header
+
+func (ht headerTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header(ht)}, nil
+}
+
+func TestKeyedTransport(t *testing.T) {
+	var (
+		clock   = &fakeClock{t: time.Unix(1000000, 0)}
+		created []string
+	)
+	kt := &KeyedTransport{
+		Key: HostPathKey("/api/", "/api/v2/"),
+		New: func(key string) Limiter {
+			created = append(created, key)
+			return mockLimiter{}
+		},
+		Idle: time.Minute,
+		T:    mockTransport{},
+		Now:  clock.Now,
+	}
+
+	cases := []struct {
+		url     string
+		advance time.Duration
+		want    []string
+	}{{
+		url:  "http://a/",
+		want: []string{"a"},
+	}, {
+		url:  "http://a/api/foo",
+		want: []string{"a", "a/api/"},
+	}, {
+		url:  "http://a/api/v2/foo",
+		want: []string{"a", "a/api/", "a/api/v2/"},
+	}, {
+		url:  "http://a/api/bar",
+		want: []string{"a", "a/api/", "a/api/v2/"},
+	}, {
+		url:     "http://b/api/bar",
+		advance: 30 * time.Second,
+		want:    []string{"a", "a/api/", "a/api/v2/", "b/api/"},
+	}, {
+		url:     "http://a/api/bar",
+		advance: 45 * time.Second,
+		want:    []string{"a", "a/api/", "a/api/v2/", "b/api/", "a/api/"},
+	}}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case_%02d", i+1), func(t *testing.T) {
+			clock.advance(tc.advance)
+			req, err := http.NewRequest("GET", tc.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := kt.RoundTrip(req); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(created) != fmt.Sprint(tc.want) {
+				t.Errorf("got %v, want %v", created, tc.want)
+			}
+		})
+	}
+
+	// Only b/api/ and a/api/ remain; the others went idle.
+	if got := kt.cache.len(); got != 2 {
+		t.Errorf("got %d limiters, want 2", got)
+	}
+}
+
+func TestRemoteLimitDeadlineNoReserve(t *testing.T) {
+	var (
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		rl    = &RemoteLimit{Now: clock.Now}
+	)
+	rl.Observe(&http.Response{Header: http.Header{"Retry-After": {"60"}}})
+
+	ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(time.Second))
+	defer cancel()
+	if err := rl.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if !rl.last.IsZero() {
+		t.Errorf("failed wait reserved a slot at %v", rl.last)
+	}
+}
@@ -0,0 +1,377 @@
+package mid
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bobg/errors"
+)
+
+// This file contains dependency-free implementations of Limiter, Allower, and StatusLimiter.
+// Each type has a Now field for injecting a clock in tests.
+// Each is safe for concurrent use
+// and must not be copied after first use.
+
+// TokenBucket is a [Limiter] and [Allower] implementing the token-bucket algorithm.
+// The bucket holds up to Burst tokens and starts out full.
+// Tokens are added at Rate per second.
+// Each operation consumes one token.
+type TokenBucket struct {
+	// Rate is the number of tokens added to the bucket per second.
+	Rate float64
+
+	// Burst is the capacity of the bucket.
+	// Values less than 1 are treated as 1.
+	Burst int
+
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Allow implements [Allower].
+func (tb *TokenBucket) Allow() bool {
+	ok, _ := tb.try(now(tb.Now))
+	return ok
+}
+
+// Wait implements [Limiter].
+func (tb *TokenBucket) Wait(ctx context.Context) error {
+	return waitLimiter(ctx, tb.Now, tb.try)
+}
+
+// RateStatus implements [StatusLimiter].
+func (tb *TokenBucket) RateStatus() RateStatus {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	burst := tb.refill(now(tb.Now))
+	status := RateStatus{
+		Limit:     int(burst),
+		Remaining: int(tb.tokens),
+	}
+	if tb.Rate > 0 {
+		status.Reset = seconds((burst - tb.tokens) / tb.Rate)
+		status.Window = seconds(burst / tb.Rate)
+		if tb.tokens < 1 {
+			status.RetryAfter = seconds((1 - tb.tokens) / tb.Rate)
+		}
+	}
+	return status
+}
+
+// refill adds tokens for the time elapsed since the last call.
+// It returns the capacity of the bucket.
+// Callers must hold tb.mu.
+func (tb *TokenBucket) refill(t time.Time) float64 {
+	burst := float64(max(tb.Burst, 1))
+	if tb.last.IsZero() {
+		tb.tokens = burst
+	} else if t.After(tb.last) {
+		tb.tokens = min(burst, tb.tokens+t.Sub(tb.last).Seconds()*tb.Rate)
+	}
+	tb.last = t
+	return burst
+}
+
+func (tb *TokenBucket) try(t time.Time) (bool, time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(t)
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true, 0
+	}
+	if tb.Rate <= 0 {
+		return false, -1
+	}
+	return false, seconds((1 - tb.tokens) / tb.Rate)
+}
+
+// FixedWindow is a [Limiter] and [Allower] that permits up to Limit operations
+// in each consecutive interval of length Window.
+// Windows are aligned to multiples of Window since the zero time.
+// If Limit or Window is not positive,
+// no operations are permitted,
+// and Wait blocks until its context is done.
+type FixedWindow struct {
+	Limit  int
+	Window time.Duration
+
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu    sync.Mutex
+	start time.Time
+	count int
+}
+
+// Allow implements [Allower].
+func (fw *FixedWindow) Allow() bool {
+	ok, _ := fw.try(now(fw.Now))
+	return ok
+}
+
+// Wait implements [Limiter].
+func (fw *FixedWindow) Wait(ctx context.Context) error {
+	return waitLimiter(ctx, fw.Now, fw.try)
+}
+
+// RateStatus implements [StatusLimiter].
+func (fw *FixedWindow) RateStatus() RateStatus {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.Window <= 0 {
+		return RateStatus{Limit: max(fw.Limit, 0)}
+	}
+
+	t := now(fw.Now)
+	fw.roll(t)
+	status := RateStatus{
+		Limit:     fw.Limit,
+		Remaining: max(fw.Limit-fw.count, 0),
+		Reset:     fw.start.Add(fw.Window).Sub(t),
+		Window:    fw.Window,
+	}
+	if status.Remaining == 0 {
+		status.RetryAfter = status.Reset
+	}
+	return status
+}
+
+// roll starts a new window if t is past the end of the current one.
+// Callers must hold fw.mu and ensure fw.Window is positive.
+func (fw *FixedWindow) roll(t time.Time) {
+	if start := t.Truncate(fw.Window); start.After(fw.start) {
+		fw.start = start
+		fw.count = 0
+	}
+}
+
+func (fw *FixedWindow) try(t time.Time) (bool, time.Duration) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.Limit <= 0 || fw.Window <= 0 {
+		return false, -1
+	}
+	fw.roll(t)
+	if fw.count < fw.Limit {
+		fw.count++
+		return true, 0
+	}
+	return false, fw.start.Add(fw.Window).Sub(t)
+}
+
+// SlidingWindowLog is a [Limiter] and [Allower] that permits up to Limit operations
+// in any interval of length Window.
+// It keeps a log of the times of up to Limit recent operations.
+type SlidingWindowLog struct {
+	Limit  int
+	Window time.Duration
+
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu  sync.Mutex
+	log []time.Time
+}
+
+// Allow implements [Allower].
+func (sw *SlidingWindowLog) Allow() bool {
+	ok, _ := sw.try(now(sw.Now))
+	return ok
+}
+
+// Wait implements [Limiter].
+func (sw *SlidingWindowLog) Wait(ctx context.Context) error {
+	return waitLimiter(ctx, sw.Now, sw.try)
+}
+
+// RateStatus implements [StatusLimiter].
+func (sw *SlidingWindowLog) RateStatus() RateStatus {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	cutoff := sw.prune(now(sw.Now))
+	status := RateStatus{
+		Limit:     sw.Limit,
+		Remaining: max(sw.Limit-len(sw.log), 0),
+		Window:    sw.Window,
+	}
+	if n := len(sw.log); n > 0 {
+		status.Reset = sw.log[n-1].Sub(cutoff)
+		if status.Remaining == 0 {
+			status.RetryAfter = sw.log[0].Sub(cutoff)
+		}
+	}
+	return status
+}
+
+// prune discards log entries outside the window ending at t.
+// It returns the start of that window.
+// Callers must hold sw.mu.
+func (sw *SlidingWindowLog) prune(t time.Time) time.Time {
+	cutoff := t.Add(-sw.Window)
+	i := 0
+	for i < len(sw.log) && !sw.log[i].After(cutoff) {
+		i++
+	}
+	sw.log = sw.log[i:]
+	return cutoff
+}
+
+func (sw *SlidingWindowLog) try(t time.Time) (bool, time.Duration) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	cutoff := sw.prune(t)
+	if len(sw.log) < sw.Limit {
+		sw.log = append(sw.log, t)
+		return true, 0
+	}
+	if len(sw.log) == 0 {
+		return false, -1
+	}
+	return false, sw.log[0].Sub(cutoff)
+}
+
+// GCRA is a [Limiter] and [Allower] implementing the generic cell rate algorithm.
+// It permits operations at Rate per second on average,
+// with bursts of up to Burst operations.
+// It is equivalent to a [TokenBucket] but keeps only a single timestamp of state.
+type GCRA struct {
+	// Rate is the sustained number of operations permitted per second.
+	Rate float64
+
+	// Burst is the number of operations that may happen at once.
+	// Values less than 1 are treated as 1.
+	Burst int
+
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu  sync.Mutex
+	tat time.Time // theoretical arrival time
+}
+
+// Allow implements [Allower].
+func (g *GCRA) Allow() bool {
+	ok, _ := g.try(now(g.Now))
+	return ok
+}
+
+// Wait implements [Limiter].
+func (g *GCRA) Wait(ctx context.Context) error {
+	return waitLimiter(ctx, g.Now, g.try)
+}
+
+// RateStatus implements [StatusLimiter].
+func (g *GCRA) RateStatus() RateStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	burst := max(g.Burst, 1)
+	if g.Rate <= 0 {
+		return RateStatus{Limit: burst}
+	}
+
+	t := now(g.Now)
+	interval, tolerance, tat := g.params(t)
+	behind := tat.Sub(t)
+	status := RateStatus{
+		Limit:  burst,
+		Reset:  behind,
+		Window: time.Duration(burst) * interval,
+	}
+	if behind > tolerance {
+		status.RetryAfter = behind - tolerance
+	} else {
+		status.Remaining = min(int((tolerance-behind)/interval)+1, burst)
+	}
+	return status
+}
+
+// params returns the emission interval, the burst tolerance,
+// and the theoretical arrival time as of t.
+// Callers must hold g.mu.
+func (g *GCRA) params(t time.Time) (interval, tolerance time.Duration, tat time.Time) {
+	interval = seconds(1 / g.Rate)
+	tolerance = time.Duration(max(g.Burst, 1)-1) * interval
+	tat = g.tat
+	if tat.Before(t) {
+		tat = t
+	}
+	return interval, tolerance, tat
+}
+
+func (g *GCRA) try(t time.Time) (bool, time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.Rate <= 0 {
+		return false, -1
+	}
+
+	interval, tolerance, tat := g.params(t)
+	if d := tat.Sub(t) - tolerance; d > 0 {
+		return false, d
+	}
+	g.tat = tat.Add(interval)
+	return true, 0
+}
+
+// waitLimiter repeatedly calls try until it succeeds,
+// sleeping in between for the duration try reports.
+// A negative duration means try will never succeed.
+func waitLimiter(ctx context.Context, nowFn func() time.Time, try func(time.Time) (bool, time.Duration)) error {
+	for {
+		t := now(nowFn)
+		ok, d := try(t)
+		if ok {
+			return nil
+		}
+		if d < 0 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		if deadline, ok := ctx.Deadline(); ok && t.Add(d).After(deadline) {
+			return errors.Wrap(context.DeadlineExceeded, "rate limit wait would exceed context deadline")
+		}
+		if err := sleepCtx(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// sleepCtx pauses for the given duration
+// or until the context is canceled,
+// whichever comes first.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func now(f func() time.Time) time.Time {
+	if f == nil {
+		return time.Now()
+	}
+	return f()
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,202 @@
+package mid
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiters(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		want    bool
+	}
+
+	cases := []struct {
+		name  string
+		mk    func(func() time.Time) Allower
+		steps []step
+	}{{
+		name: "token_bucket",
+		mk: func(now func() time.Time) Allower {
+			return &TokenBucket{Rate: 2, Burst: 2, Now: now}
+		},
+		steps: []step{
+			{want: true},
+			{want: true},
+			{want: false},
+			{advance: 250 * time.Millisecond, want: false},
+			{advance: 250 * time.Millisecond, want: true},
+			{want: false},
+			{advance: 10 * time.Second, want: true},
+			{want: true},
+			{want: false},
+		},
+	}, {
+		name: "fixed_window",
+		mk: func(now func() time.Time) Allower {
+			return &FixedWindow{Limit: 2, Window: time.Second, Now: now}
+		},
+		steps: []step{
+			{advance: 900 * time.Millisecond, want: true},
+			{want: true},
+			{want: false},
+			{advance: 100 * time.Millisecond, want: true},
+			{want: true},
+			{want: false},
+		},
+	}, {
+		name: "sliding_window_log",
+		mk: func(now func() time.Time) Allower {
+			return &SlidingWindowLog{Limit: 2, Window: time.Second, Now: now}
+		},
+		steps: []step{
+			{advance: 900 * time.Millisecond, want: true},
+			{want: true},
+			{want: false},
+			{advance: 100 * time.Millisecond, want: false},
+			{advance: 900 * time.Millisecond, want: true},
+			{want: true},
+			{want: false},
+		},
+	}, {
+		name: "gcra",
+		mk: func(now func() time.Time) Allower {
+			return &GCRA{Rate: 2, Burst: 2, Now: now}
+		},
+		steps: []step{
+			{want: true},
+			{want: true},
+			{want: false},
+			{advance: 250 * time.Millisecond, want: false},
+			{advance: 250 * time.Millisecond, want: true},
+			{want: false},
+			{advance: 10 * time.Second, want: true},
+			{want: true},
+			{want: false},
+		},
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := &fakeClock{t: time.Unix(1000000, 0)}
+			lim := tc.mk(clock.Now)
+			for i, s := range tc.steps {
+				clock.advance(s.advance)
+				if got := lim.Allow(); got != s.want {
+					t.Errorf("step %d: got %v, want %v", i+1, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	limiters := map[string]Limiter{
+		"token_bucket":       &TokenBucket{Rate: 100, Burst: 1},
+		"fixed_window":       &FixedWindow{Limit: 1, Window: 10 * time.Millisecond},
+		"sliding_window_log": &SlidingWindowLog{Limit: 1, Window: 10 * time.Millisecond},
+		"gcra":               &GCRA{Rate: 100, Burst: 1},
+	}
+
+	for name, lim := range limiters {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := lim.Wait(ctx); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			ctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+			defer cancel()
+			if err := lim.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+			}
+		})
+	}
+}
+
+func TestFixedWindowInvalid(t *testing.T) {
+	for _, fw := range []*FixedWindow{{Limit: 1}, {Limit: 0, Window: time.Second}, {Limit: 1, Window: -time.Second}} {
+		if fw.Allow() {
+			t.Errorf("%d per %s: allowed", fw.Limit, fw.Window)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := fw.Wait(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("%d per %s: got error %v, want %v", fw.Limit, fw.Window, err, context.Canceled)
+		}
+	}
+}
+
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+func TestRateStatus(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000000, 0)}
+
+	cases := []struct {
+		name string
+		lim  interface {
+			Allower
+			StatusLimiter
+		}
+		want RateStatus
+	}{{
+		name: "token_bucket",
+		lim:  &TokenBucket{Rate: 2, Burst: 4, Now: clock.Now},
+		want: RateStatus{Limit: 4, Remaining: 0, Reset: 2 * time.Second, RetryAfter: 500 * time.Millisecond, Window: 2 * time.Second},
+	}, {
+		name: "fixed_window",
+		lim:  &FixedWindow{Limit: 4, Window: 10 * time.Second, Now: clock.Now},
+		want: RateStatus{Limit: 4, Remaining: 0, Reset: 10 * time.Second, RetryAfter: 10 * time.Second, Window: 10 * time.Second},
+	}, {
+		name: "sliding_window_log",
+		lim:  &SlidingWindowLog{Limit: 4, Window: 10 * time.Second, Now: clock.Now},
+		want: RateStatus{Limit: 4, Remaining: 0, Reset: 10 * time.Second, RetryAfter: 10 * time.Second, Window: 10 * time.Second},
+	}, {
+		name: "gcra",
+		lim:  &GCRA{Rate: 2, Burst: 4, Now: clock.Now},
+		want: RateStatus{Limit: 4, Remaining: 0, Reset: 2 * time.Second, RetryAfter: 500 * time.Millisecond, Window: 2 * time.Second},
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.lim.RateStatus(); got.Remaining != tc.want.Limit {
+				t.Errorf("initially got %d remaining, want %d", got.Remaining, tc.want.Limit)
+			}
+			for i := 0; i < tc.want.Limit; i++ {
+				if !tc.lim.Allow() {
+					t.Fatalf("operation %d not allowed", i+1)
+				}
+			}
+			if got := tc.lim.RateStatus(); got != tc.want {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
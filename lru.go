@@ -0,0 +1,61 @@
+package mid
+
+import (
+	"container/list"
+	"time"
+)
+
+// lruCache is a map of bounded size.
+// When full, adding a new entry evicts the least recently used one.
+// Entries may also be evicted after going unused for a while.
+// It is not safe for concurrent use;
+// callers must supply their own locking.
+type lruCache[K comparable, V any] struct {
+	size int           // zero means unbounded
+	idle time.Duration // zero means no idle eviction
+	ll   list.List
+	m    map[K]*list.Element
+}
+
+type lruEntry[K comparable, V any] struct {
+	key  K
+	val  V
+	used time.Time
+}
+
+// get returns the value for k,
+// marking it as most recently used at time t.
+// If there is no such value,
+// one is created with mk and added to the cache.
+func (c *lruCache[K, V]) get(k K, t time.Time, mk func() V) V {
+	if c.m == nil {
+		c.m = make(map[K]*list.Element)
+	}
+	if c.idle > 0 {
+		cutoff := t.Add(-c.idle)
+		for el := c.ll.Back(); el != nil && el.Value.(*lruEntry[K, V]).used.Before(cutoff); el = c.ll.Back() {
+			c.remove(el)
+		}
+	}
+	if el, ok := c.m[k]; ok {
+		c.ll.MoveToFront(el)
+		entry := el.Value.(*lruEntry[K, V])
+		entry.used = t
+		return entry.val
+	}
+	v := mk()
+	c.m[k] = c.ll.PushFront(&lruEntry[K, V]{key: k, val: v, used: t})
+	for c.size > 0 && c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+	}
+	return v
+}
+
+func (c *lruCache[K, V]) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.m, el.Value.(*lruEntry[K, V]).key)
+}
+
+func (c *lruCache[K, V]) len() int {
+	return c.ll.Len()
+}
@@ -0,0 +1,228 @@
+package mid
+
+import (
+	"context"
+	"crypto/sha256"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/bobg/errors"
+)
+
+// MemSessionStore is an in-memory [SessionStore].
+// Its sessions are of type [*BasicSession].
+// It is safe for concurrent use.
+//
+// Expired and canceled sessions are discarded by [MemSessionStore.Purge],
+// which can be run periodically with [MemSessionStore.Sweep].
+//
+// A MemSessionStore must not be copied after first use.
+type MemSessionStore struct {
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	sessions map[string]*BasicSession
+	aliases  map[string]memSessionAlias // old keys of rotated sessions
+}
+
+type memSessionAlias struct {
+	key     string
+	csrfKey [sha256.Size]byte // the session's CSRF key before rotation
+	until   time.Time
+}
+
+var (
+	_ SessionCreator = &MemSessionStore{}
+	_ Renewer        = &MemSessionStore{}
+	_ Rotator        = &MemSessionStore{}
+	_ SessionSaver   = &MemSessionStore{}
+)
+
+// Create implements [SessionCreator].
+func (s *MemSessionStore) Create(_ context.Context, exp time.Time) (string, Session, error) {
+	key, err := NewSessionKey()
+	if err != nil {
+		return "", nil, err
+	}
+	sess, err := NewBasicSession(now(s.Now), exp)
+	if err != nil {
+		return "", nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sessions == nil {
+		s.sessions = make(map[string]*BasicSession)
+	}
+	s.sessions[key] = sess
+	return key, sess.clone(), nil
+}
+
+// Get implements [SessionStore].
+// It returns [ErrNoSession] for expired sessions.
+// For the old key of a rotated session,
+// the session has the CSRF key from before rotation
+// (see [Rotator]).
+func (s *MemSessionStore) Get(_ context.Context, key string) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, sess, ok := s.resolve(key)
+	if !ok {
+		return nil, ErrNoSession
+	}
+	sess = sess.clone()
+	if alias, ok := s.aliases[key]; ok {
+		sess.csrfKey = alias.csrfKey
+	}
+	return sess, nil
+}
+
+// Cancel implements [SessionStore].
+func (s *MemSessionStore) Cancel(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, sess, ok := s.resolve(key); ok {
+		sess.canceled = true
+	}
+	return nil
+}
+
+// Renew implements [Renewer].
+// The key does not change,
+// unless the given key is the old key of a rotated session
+// (see [MemSessionStore.Rotate]),
+// in which case the new key is returned.
+func (s *MemSessionStore) Renew(_ context.Context, key string, exp time.Time) (string, Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, sess, ok := s.resolve(key)
+	if !ok {
+		return "", nil, ErrNoSession
+	}
+	sess.exp = exp
+	return key, sess.clone(), nil
+}
+
+// Rotate implements [Rotator].
+func (s *MemSessionStore) Rotate(_ context.Context, oldKey string, grace time.Duration) (string, Session, error) {
+	newKey, err := NewSessionKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldKey, sess, ok := s.resolve(oldKey)
+	if !ok {
+		return "", nil, ErrNoSession
+	}
+	oldCSRFKey := sess.csrfKey
+	if err := sess.newCSRFKey(); err != nil {
+		return "", nil, err
+	}
+
+	delete(s.sessions, oldKey)
+	s.sessions[newKey] = sess
+
+	if grace > 0 {
+		if s.aliases == nil {
+			s.aliases = make(map[string]memSessionAlias)
+		}
+		s.aliases[oldKey] = memSessionAlias{key: newKey, csrfKey: oldCSRFKey, until: now(s.Now).Add(grace)}
+	}
+
+	return newKey, sess.clone(), nil
+}
+
+// Save implements [SessionSaver].
+// The session must be a [*BasicSession].
+// Only its data is saved.
+func (s *MemSessionStore) Save(_ context.Context, key string, sess Session) (string, error) {
+	bs, ok := sess.(*BasicSession)
+	if !ok {
+		return "", errors.Newf("cannot save session of type %T", sess)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, stored, ok := s.resolve(key)
+	if !ok {
+		return "", ErrNoSession
+	}
+	stored.data = maps.Clone(bs.data)
+	return key, nil
+}
+
+// resolve finds the unexpired session for a key,
+// following the alias for a rotated session's old key.
+// It returns the session's current key and the session.
+// Callers must hold s.mu.
+func (s *MemSessionStore) resolve(key string) (string, *BasicSession, bool) {
+	t := now(s.Now)
+
+	if alias, ok := s.aliases[key]; ok {
+		if !t.Before(alias.until) {
+			delete(s.aliases, key)
+			return "", nil, false
+		}
+		key = alias.key
+	}
+
+	sess, ok := s.sessions[key]
+	if !ok {
+		return "", nil, false
+	}
+	if !t.Before(sess.exp) {
+		delete(s.sessions, key)
+		return "", nil, false
+	}
+	return key, sess, true
+}
+
+// Purge discards expired and canceled sessions,
+// and the expired old keys of rotated sessions.
+// It returns the number of sessions discarded.
+func (s *MemSessionStore) Purge() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := now(s.Now)
+
+	var n int
+	for key, sess := range s.sessions {
+		if sess.canceled || !t.Before(sess.exp) {
+			delete(s.sessions, key)
+			n++
+		}
+	}
+	for key, alias := range s.aliases {
+		if _, ok := s.sessions[alias.key]; !ok || !t.Before(alias.until) {
+			delete(s.aliases, key)
+		}
+	}
+	return n
+}
+
+// Sweep calls Purge every interval until the context is canceled.
+// It is meant to be run in its own goroutine.
+func (s *MemSessionStore) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Purge()
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package mid
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemSessionStore(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		store = &MemSessionStore{Now: clock.Now}
+	)
+
+	key1, s1, err := store.Create(ctx, clock.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, s2, err := store.Create(ctx, clock.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key3, _, err := store.Create(ctx, clock.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key1 == key2 {
+		t.Fatal("got duplicate session keys")
+	}
+	if s1.CSRFKey() == s2.CSRFKey() {
+		t.Fatal("got duplicate CSRF keys")
+	}
+
+	got, err := store.Get(ctx, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CSRFKey() != s1.CSRFKey() || !got.Active() || !got.Exp().Equal(s1.Exp()) {
+		t.Errorf("got session %+v, want %+v", got, s1)
+	}
+
+	if _, err := store.Get(ctx, "bogus"); !errors.Is(err, ErrNoSession) {
+		t.Errorf("got error %v, want %v", err, ErrNoSession)
+	}
+
+	if err := store.Cancel(ctx, key2); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Cancel(ctx, "bogus"); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.Get(ctx, key2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Active() {
+		t.Error("canceled session is active")
+	}
+
+	clock.advance(90 * time.Minute)
+	if _, err := store.Get(ctx, key1); !errors.Is(err, ErrNoSession) {
+		t.Errorf("got error %v for expired session, want %v", err, ErrNoSession)
+	}
+
+	if n := store.Purge(); n != 1 {
+		t.Errorf("purged %d sessions, want 1", n)
+	}
+	if _, err := store.Get(ctx, key3); err != nil {
+		t.Errorf("got error %v for live session", err)
+	}
+}
+
+func TestMemSessionStoreSessionHandler(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = &MemSessionStore{}
+	)
+	key, _, err := store.Create(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := SessionHandler(store, "session", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	for _, cancel := range []bool{false, true} {
+		if cancel {
+			if err := store.Cancel(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: key})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		want := http.StatusNoContent
+		if cancel {
+			want = http.StatusForbidden
+		}
+		if rec.Code != want {
+			t.Errorf("canceled=%v: got status %d, want %d", cancel, rec.Code, want)
+		}
+	}
+}
+
+func TestMemSessionStoreSweep(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = &MemSessionStore{}
+	)
+	key, _, err := store.Create(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Cancel(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		store.Sweep(ctx, time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := store.Get(ctx, key); errors.Is(err, ErrNoSession) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("canceled session was not swept")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestMemSessionStoreRotate(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		store = &MemSessionStore{Now: clock.Now}
+	)
+
+	oldKey, s1, err := store.Create(ctx, clock.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, s2, err := store.Rotate(ctx, oldKey, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKey == oldKey {
+		t.Fatal("session key did not change")
+	}
+	if s2.CSRFKey() == s1.CSRFKey() {
+		t.Error("CSRF key did not change")
+	}
+	if !s2.Exp().Equal(s1.Exp()) {
+		t.Errorf("got expiration %v, want %v", s2.Exp(), s1.Exp())
+	}
+
+	// Within the grace period, the old key still works,
+	// and so do CSRF tokens made before the rotation.
+	csrfOpts := CSRFOpts{Now: clock.Now}
+	tok, err := CSRFTokenOpts(s1, csrfOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get(ctx, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CSRFCheckOpts(got, tok, csrfOpts); err != nil {
+		t.Errorf("CSRF token from before rotation is invalid with the old key: %s", err)
+	}
+	if got, err = store.Get(ctx, newKey); err != nil {
+		t.Fatal(err)
+	}
+	if got.CSRFKey() != s2.CSRFKey() {
+		t.Error("got stale session for new key")
+	}
+	if err := CSRFCheckOpts(got, tok, csrfOpts); err == nil {
+		t.Error("CSRF token from before rotation is valid with the new key")
+	}
+
+	key, _, err := store.Renew(ctx, oldKey, clock.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != newKey {
+		t.Error("renewing with the old key did not return the new key")
+	}
+
+	clock.advance(time.Minute)
+	if _, err := store.Get(ctx, oldKey); !errors.Is(err, ErrNoSession) {
+		t.Errorf("got error %v for old key after grace period, want %v", err, ErrNoSession)
+	}
+	if _, err := store.Get(ctx, newKey); err != nil {
+		t.Errorf("got error %v for new key", err)
+	}
+
+	// Without a grace period, the old key is invalid at once.
+	newerKey, _, err := store.Rotate(ctx, newKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, newKey); !errors.Is(err, ErrNoSession) {
+		t.Errorf("got error %v for old key, want %v", err, ErrNoSession)
+	}
+	if _, err := store.Get(ctx, newerKey); err != nil {
+		t.Errorf("got error %v for new key", err)
+	}
+
+	if _, _, err := store.Rotate(ctx, "bogus", time.Minute); !errors.Is(err, ErrNoSession) {
+		t.Errorf("got error %v rotating nonexistent session, want %v", err, ErrNoSession)
+	}
+}
@@ -0,0 +1,73 @@
+package mid
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	trusted := []string{"https://partner.example/"}
+
+	cases := []struct {
+		name                  string
+		site, origin, referer string
+		wantErr               bool
+	}{
+		{name: "no headers"},
+		{name: "same-origin fetch", site: "same-origin", origin: "https://evil.example"},
+		{name: "user-initiated", site: "none"},
+		{name: "same host", site: "same-site", origin: "https://app.example"},
+		{name: "trusted", site: "cross-site", origin: "https://partner.example"},
+		{name: "untrusted", site: "cross-site", origin: "https://evil.example", wantErr: true},
+		{name: "untrusted origin only", origin: "https://evil.example", wantErr: true},
+		{name: "null origin", origin: "null", wantErr: true},
+		{name: "referer", referer: "https://app.example/form"},
+		{name: "untrusted referer", referer: "https://evil.example/form", wantErr: true},
+		{name: "cross-site without origin", site: "cross-site", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "https://app.example/transfer", nil)
+			if tc.site != "" {
+				req.Header.Set("Sec-Fetch-Site", tc.site)
+			}
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			if tc.referer != "" {
+				req.Header.Set("Referer", tc.referer)
+			}
+			err := CheckOrigin(req, trusted)
+			if tc.wantErr {
+				if !errors.Is(err, ErrOrigin) {
+					t.Errorf("got error %v, want %s", err, ErrOrigin)
+				}
+			} else if err != nil {
+				t.Errorf("got error %s, want nil", err)
+			}
+		})
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	h := SameOrigin(nil, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	for _, tc := range []struct {
+		method string
+		want   int
+	}{
+		{"GET", http.StatusNoContent},
+		{"POST", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(tc.method, "https://app.example/", nil)
+		req.Header.Set("Origin", "https://evil.example")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.method, rec.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package mid
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bobg/errors"
+)
+
+// Allower is the non-blocking counterpart of [Limiter].
+// Calling Allow reports whether the operation may proceed now,
+// consuming some of the limiter's capacity if so.
+//
+// This interface is satisfied by the *Limiter type in golang.org/x/time/rate.
+type Allower interface {
+	Allow() bool
+}
+
+// RateClass is a class of keys for per-key rate limiting with a [RateLimiter].
+// For example, one class might limit anonymous requests by remote IP address
+// while another, more generous one limits authenticated requests by session.
+type RateClass struct {
+	// Name distinguishes the keys of this class from those of other classes.
+	Name string
+
+	// Key extracts a rate-limiting key from a request.
+	// If it returns "", this class does not apply to the request.
+	Key func(*http.Request) string
+
+	// New creates the limiter for a key in this class
+	// the first time (or the first time since eviction) that the key is seen.
+	New func() Allower
+}
+
+// DefaultRateLimiterSize is the number of per-key limiters kept by a [RateLimiter] whose Size is zero.
+const DefaultRateLimiterSize = 10000
+
+// RateLimiter limits the rate of incoming requests separately for each of many keys,
+// so that one noisy client cannot starve the others.
+// See [RateLimit].
+//
+// A RateLimiter must not be copied after first use.
+type RateLimiter struct {
+	// Classes are the key classes of this limiter.
+	// The first class whose Key function produces a non-empty key for a request
+	// is the one that applies to it.
+	// Requests to which no class applies are not limited.
+	Classes []RateClass
+
+	// Size is the maximum number of per-key limiters to keep.
+	// When this is exceeded,
+	// the least recently used limiter is discarded.
+	// If this is zero, DefaultRateLimiterSize is used.
+	Size int
+
+	mu    sync.Mutex
+	cache *lruCache[rateKey, Allower]
+}
+
+type rateKey struct {
+	class, key string
+}
+
+// Limiter returns the limiter that applies to the given request,
+// creating it if necessary.
+// It returns nil if no class applies to the request.
+func (rl *RateLimiter) Limiter(req *http.Request) Allower {
+	for _, class := range rl.Classes {
+		key := class.Key(req)
+		if key == "" {
+			continue
+		}
+
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+
+		if rl.cache == nil {
+			size := rl.Size
+			if size == 0 {
+				size = DefaultRateLimiterSize
+			}
+			rl.cache = &lruCache[rateKey, Allower]{size: size}
+		}
+		return rl.cache.get(rateKey{class: class.Name, key: key}, time.Now(), class.New)
+	}
+	return nil
+}
+
+// ErrRateLimited is the error produced when a request is rejected by [RateLimit].
+var ErrRateLimited = errors.New("rate limited")
+
+// RateLimit is an [http.Handler] middleware wrapper.
+// It looks up the limiter for each incoming request in rl
+// and rejects the request with 429 Too Many Requests
+// (via a [CodeErr] wrapping [ErrRateLimited])
+// if that limiter does not allow it.
+//
+// If the limiter is a [StatusLimiter],
+// the response includes the RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, and RateLimit-Policy
+// header fields described in the IETF draft "RateLimit header fields for HTTP",
+// and rejections include a Retry-After field.
+func RateLimit(rl *RateLimiter, next http.Handler) http.Handler {
+	return Err(func(w http.ResponseWriter, req *http.Request) error {
+		lim := rl.Limiter(req)
+		if lim == nil {
+			next.ServeHTTP(w, req)
+			return nil
+		}
+		ok := lim.Allow()
+		if sl, isSL := lim.(StatusLimiter); isSL {
+			status := sl.RateStatus()
+			status.setHeader(w.Header())
+			if !ok {
+				setRetryAfter(w.Header(), status.RetryAfter)
+			}
+		}
+		if !ok {
+			return CodeErr{C: http.StatusTooManyRequests, Err: ErrRateLimited}
+		}
+		next.ServeHTTP(w, req)
+		return nil
+	})
+}
+
+// RemoteIPKey is a key function for [RateClass] that produces the IP address of the request's remote end.
+// It does not consult headers such as X-Forwarded-For,
+// which clients can forge.
+func RemoteIPKey(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// HeaderKey produces a key function for [RateClass]
+// that returns the value of the given request header field,
+// such as one carrying an API key.
+func HeaderKey(field string) func(*http.Request) string {
+	return func(req *http.Request) string {
+		return strings.TrimSpace(req.Header.Get(field))
+	}
+}
+
+// SessionKey is a key function for [RateClass] that identifies the request's [Session],
+// as placed in the request context by [SessionHandler].
+// It returns "" if there is no session.
+//
+// The key is derived from the session's CSRF key by hashing,
+// so it does not reveal that secret.
+func SessionKey(req *http.Request) string {
+	s := ContextSession(req.Context())
+	if s == nil {
+		return ""
+	}
+	csrfKey := s.CSRFKey()
+	sum := sha256.Sum256(csrfKey[:])
+	return hex.EncodeToString(sum[:])
+}
+
+// RateStatus describes the quota of a rate limiter at a moment in time.
+type RateStatus struct {
+	// Limit is the number of operations permitted per Window.
+	Limit int
+
+	// Remaining is the number of operations that may proceed right now.
+	Remaining int
+
+	// Reset is the time until the full quota is available again.
+	Reset time.Duration
+
+	// RetryAfter is the time until the next operation may proceed.
+	// It is zero when Remaining is positive.
+	RetryAfter time.Duration
+
+	// Window is the interval over which Limit applies.
+	Window time.Duration
+}
+
+// StatusLimiter is a limiter that can report its [RateStatus].
+// The limiter types in this package all implement it.
+type StatusLimiter interface {
+	RateStatus() RateStatus
+}
+
+func (rs RateStatus) setHeader(h http.Header) {
+	h.Set("RateLimit-Limit", strconv.Itoa(rs.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(rs.Remaining))
+	h.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(rs.Reset), 10))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rs.Limit, ceilSeconds(rs.Window)))
+}
@@ -0,0 +1,164 @@
+package mid
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	rl := &RateLimiter{
+		Classes: []RateClass{{
+			Name: "apikey",
+			Key:  HeaderKey("X-Api-Key"),
+			New:  func() Allower { return &countAllower{n: 3} },
+		}, {
+			Name: "ip",
+			Key:  RemoteIPKey,
+			New:  func() Allower { return &countAllower{n: 1} },
+		}},
+	}
+
+	h := RateLimit(rl, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	cases := []struct {
+		remoteAddr, apiKey string
+		wantStatus         int
+	}{{
+		remoteAddr: "10.0.0.1:1234",
+		wantStatus: http.StatusNoContent,
+	}, {
+		remoteAddr: "10.0.0.1:5678",
+		wantStatus: http.StatusTooManyRequests,
+	}, {
+		remoteAddr: "10.0.0.2:1234",
+		wantStatus: http.StatusNoContent,
+	}, {
+		remoteAddr: "10.0.0.1:1234",
+		apiKey:     "k",
+		wantStatus: http.StatusNoContent,
+	}, {
+		remoteAddr: "10.0.0.2:1234",
+		apiKey:     "k",
+		wantStatus: http.StatusNoContent,
+	}, {
+		remoteAddr: "10.0.0.3:1234",
+		apiKey:     "k",
+		wantStatus: http.StatusNoContent,
+	}, {
+		remoteAddr: "10.0.0.4:1234",
+		apiKey:     "k",
+		wantStatus: http.StatusTooManyRequests,
+	}}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case_%02d", i+1), func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.apiKey != "" {
+				req.Header.Set("X-Api-Key", tc.apiKey)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tc.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	rl := &RateLimiter{
+		Classes: []RateClass{{
+			Key: HeaderKey("X-Key"),
+			New: func() Allower { return &countAllower{n: 1} },
+		}},
+		Size: 2,
+	}
+
+	get := func(key string) Allower {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Key", key)
+		return rl.Limiter(req)
+	}
+
+	a := get("a")
+	get("b")
+	if got := get("a"); got != a {
+		t.Error("limiter for a was evicted too soon")
+	}
+	get("c") // evicts b
+	if got := get("a"); got != a {
+		t.Error("limiter for a was evicted, want b evicted")
+	}
+	if got := rl.cache.len(); got != 2 {
+		t.Errorf("got %d limiters, want 2", got)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	if got := rl.Limiter(req); got != nil {
+		t.Errorf("got limiter %v for unkeyed request, want nil", got)
+	}
+}
+
+type countAllower struct {
+	n int
+}
+
+func (c *countAllower) Allow() bool {
+	if c.n <= 0 {
+		return false
+	}
+	c.n--
+	return true
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000020, 0)} // a multiple of one minute
+	rl := &RateLimiter{
+		Classes: []RateClass{{
+			Key: RemoteIPKey,
+			New: func() Allower { return &FixedWindow{Limit: 2, Window: time.Minute, Now: clock.Now} },
+		}},
+	}
+	h := RateLimit(rl, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	cases := []struct {
+		wantStatus                    int
+		wantRemaining, wantRetryAfter string
+	}{{
+		wantStatus:    http.StatusNoContent,
+		wantRemaining: "1",
+	}, {
+		wantStatus:    http.StatusNoContent,
+		wantRemaining: "0",
+	}, {
+		wantStatus:     http.StatusTooManyRequests,
+		wantRemaining:  "0",
+		wantRetryAfter: "60",
+	}}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case_%02d", i+1), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if rec.Code != tc.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tc.wantStatus)
+			}
+			hdr := rec.Result().Header
+			for field, want := range map[string]string{
+				"RateLimit-Limit":     "2",
+				"RateLimit-Remaining": tc.wantRemaining,
+				"RateLimit-Reset":     "60",
+				"RateLimit-Policy":    "2;w=60",
+				"Retry-After":         tc.wantRetryAfter,
+			} {
+				if got := hdr.Get(field); got != want {
+					t.Errorf("got %s %q, want %q", field, got, want)
+				}
+			}
+		})
+	}
+}
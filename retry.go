@@ -0,0 +1,146 @@
+package mid
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/bobg/errors"
+)
+
+// RetryTransport is an [http.RoundTripper] that retries failed requests
+// with exponential backoff and full jitter.
+// It delegates each attempt to the http.RoundTripper in T.
+// If T is nil, it uses [http.DefaultTransport].
+// Setting T to a [LimitedTransport] makes every attempt,
+// not just every request,
+// wait for the limiter.
+//
+// A request is retried when its attempt produces an error
+// (other than cancellation of the request's context)
+// or a response with status 429 Too Many Requests,
+// or any 5xx status other than 501 Not Implemented.
+// Only idempotent requests are retried:
+// those whose methods are GET, HEAD, OPTIONS, TRACE, PUT, or DELETE,
+// and those carrying an Idempotency-Key or X-Idempotency-Key header field
+// (see also [Trace]).
+// A request with a body is retried only if its GetBody field is set.
+//
+// The delay before retry number n (counting from zero) is a random duration
+// between zero and Base*2^n, capped at Cap.
+// If the response includes a Retry-After field, that delay is used instead,
+// unless it exceeds Cap.
+// No retry is made if the Retry-After delay exceeds Cap,
+// or if the delay would exceed the request context's deadline.
+// In that case, or when attempts are exhausted,
+// the result of the last attempt is returned.
+type RetryTransport struct {
+	T http.RoundTripper
+
+	// Attempts is the maximum number of attempts, including the first.
+	// If this is zero, 3 is used.
+	Attempts int
+
+	// Base is the base delay for the backoff computation.
+	// If this is zero, 100 milliseconds is used.
+	Base time.Duration
+
+	// Cap is the maximum delay before a retry,
+	// whether computed by backoff or requested with Retry-After.
+	// If this is zero, 10 seconds is used.
+	Cap time.Duration
+}
+
+// RoundTrip implements the [http.RoundTripper] interface.
+func (rt RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var (
+		ctx      = req.Context()
+		next     = rt.T
+		attempts = rt.Attempts
+		base     = rt.Base
+		maxDelay = rt.Cap
+	)
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if attempts == 0 {
+		attempts = 3
+	}
+	if base == 0 {
+		base = 100 * time.Millisecond
+	}
+	if maxDelay == 0 {
+		maxDelay = 10 * time.Second
+	}
+	if !isIdempotent(req) || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		attempts = 1
+	}
+
+	attemptReq := req
+	for attempt := 0; ; attempt++ {
+		resp, err := next.RoundTrip(attemptReq)
+		if attempt+1 >= attempts || !shouldRetry(resp, err) || ctx.Err() != nil {
+			return resp, err
+		}
+
+		backoff := min(maxDelay, base<<attempt)
+		if backoff <= 0 { // overflow
+			backoff = maxDelay
+		}
+		delay := time.Duration(rand.Int63n(int64(backoff) + 1))
+		if resp != nil {
+			if d, ok := retryAfter(resp.Header, time.Now()); ok {
+				if d > maxDelay {
+					return resp, err
+				}
+				delay = d
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return resp, err
+		}
+
+		if resp != nil {
+			// Drain some of the body so the connection can be reused.
+			_, _ = io.CopyN(io.Discard, resp.Body, 4096)
+			resp.Body.Close()
+		}
+
+		if err := sleepCtx(ctx, delay); err != nil {
+			return nil, err
+		}
+
+		attemptReq = req.Clone(ctx)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, errors.Wrap(err, "rewinding request body")
+			}
+			attemptReq.Body = body
+		}
+	}
+}
+
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	case resp.StatusCode == http.StatusNotImplemented:
+		return false
+	default:
+		return resp.StatusCode >= 500
+	}
+}
+
+// isIdempotent tells whether req may safely be sent more than once.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return idempotencyKey(req) != ""
+}
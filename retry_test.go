@@ -0,0 +1,175 @@
+package mid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryTransport(t *testing.T) {
+	connErr := errors.New("connection refused")
+
+	cases := []struct {
+		method, body, idempotencyKey string
+		retryAfter                   string
+		timeout                      time.Duration
+		results                      []any // status code or error
+		wantCalls, wantStatus        int
+		wantErr                      error
+	}{{
+		method:     "GET",
+		results:    []any{503, 200},
+		wantCalls:  2,
+		wantStatus: 200,
+	}, {
+		method:     "GET",
+		results:    []any{connErr, 429, 200},
+		wantCalls:  3,
+		wantStatus: 200,
+	}, {
+		method:     "GET",
+		results:    []any{500, 502, 504, 200},
+		wantCalls:  3,
+		wantStatus: 504,
+	}, {
+		method:     "GET",
+		results:    []any{501, 200},
+		wantCalls:  1,
+		wantStatus: 501,
+	}, {
+		method:     "GET",
+		results:    []any{404, 200},
+		wantCalls:  1,
+		wantStatus: 404,
+	}, {
+		method:     "POST",
+		body:       "hello",
+		results:    []any{503, 200},
+		wantCalls:  1,
+		wantStatus: 503,
+	}, {
+		method:         "POST",
+		body:           "hello",
+		idempotencyKey: "k",
+		results:        []any{503, 200},
+		wantCalls:      2,
+		wantStatus:     200,
+	}, {
+		method:    "PUT",
+		body:      "hello",
+		results:   []any{connErr, connErr, connErr},
+		wantCalls: 3,
+		wantErr:   connErr,
+	}, {
+		method:     "GET",
+		retryAfter: "3600",
+		timeout:    time.Second,
+		results:    []any{503, 200},
+		wantCalls:  1,
+		wantStatus: 503,
+	}, {
+		method:     "GET",
+		retryAfter: "3600",
+		results:    []any{503, 200},
+		wantCalls:  1,
+		wantStatus: 503,
+	}, {
+		method:     "GET",
+		retryAfter: "99999999999999",
+		results:    []any{503, 200},
+		wantCalls:  1,
+		wantStatus: 503,
+	}, {
+		method:     "GET",
+		retryAfter: "0",
+		results:    []any{429, 200},
+		wantCalls:  2,
+		wantStatus: 200,
+	}}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case_%02d", i+1), func(t *testing.T) {
+			ctx := context.Background()
+			if tc.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+
+			var body io.Reader
+			if tc.body != "" {
+				body = strings.NewReader(tc.body)
+			}
+			req, err := http.NewRequestWithContext(ctx, tc.method, "http://example.com/", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.idempotencyKey != "" {
+				req.Header.Set("Idempotency-Key", tc.idempotencyKey)
+			}
+
+			st := &scriptTransport{results: tc.results, retryAfter: tc.retryAfter}
+			rt := RetryTransport{T: st, Base: time.Millisecond}
+			resp, err := rt.RoundTrip(req)
+
+			if st.calls != tc.wantCalls {
+				t.Errorf("got %d calls, want %d", st.calls, tc.wantCalls)
+			}
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("got error %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+			for j, b := range st.bodies {
+				if b != tc.body {
+					t.Errorf("attempt %d: got body %q, want %q", j+1, b, tc.body)
+				}
+			}
+		})
+	}
+}
+
+// scriptTransport is an http.RoundTripper producing a scripted sequence of results.
+type scriptTransport struct {
+	results    []any
+	retryAfter string
+	calls      int
+	bodies     []string
+}
+
+func (st *scriptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		st.bodies = append(st.bodies, string(b))
+	}
+
+	res := st.results[st.calls]
+	st.calls++
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+	resp := &http.Response{
+		StatusCode: res.(int),
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("")),
+	}
+	if st.retryAfter != "" {
+		resp.Header.Set("Retry-After", st.retryAfter)
+	}
+	return resp, nil
+}
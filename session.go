@@ -6,8 +6,11 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/bobg/errors"
@@ -25,26 +28,67 @@ type Session interface {
 	Exp() time.Time
 }
 
-const csrfNonceLen = 16
+const (
+	csrfNonceLen = 16
+	csrfTimeLen  = 8
+	csrfTokenLen = csrfNonceLen + csrfTimeLen + sha256.Size
+)
+
+// DefaultCSRFMaxAge is the maximum age of a CSRF token
+// when none is given in [CSRFOpts].
+const DefaultCSRFMaxAge = 24 * time.Hour
+
+// CSRFOpts are options for [CSRFTokenOpts] and [CSRFCheckOpts].
+type CSRFOpts struct {
+	// MaxAge is how long a token remains valid after it is generated.
+	// If this is zero, DefaultCSRFMaxAge is used.
+	MaxAge time.Duration
+
+	// Action, if not "", binds a token to a specific action,
+	// such as the submission of a particular form
+	// (see [CSRFAction]).
+	// A token generated for one action is not valid for another,
+	// nor for none.
+	Action string
+
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// CSRFAction is a conventional value for [CSRFOpts].Action
+// identifying the request with the given method and URL path.
+func CSRFAction(method, path string) string {
+	return strings.ToUpper(method) + " " + path
+}
 
-// CSRFToken generates a new token containing a random nonce hashed with this session's CSRF key.
+// CSRFToken generates a new token containing a random nonce and the current time,
+// hashed with this session's CSRF key.
 // It can be used to protect against CSRF attacks.
 // Resources served by the application (e.g. HTML pages) should include a CSRF token.
 // State-changing requests to the application that rely on a Session for authentication
 // should require the caller to supply a valid CSRF token.
 // Validity can be checked with CSRFCheck.
 // For more on this topic see https://en.wikipedia.org/wiki/Cross-site_request_forgery.
+//
+// CSRFToken(s) is the same as CSRFTokenOpts(s, CSRFOpts{}).
 func CSRFToken(s Session) (string, error) {
-	var buf [csrfNonceLen + sha256.Size]byte
+	return CSRFTokenOpts(s, CSRFOpts{})
+}
+
+// CSRFTokenOpts is like [CSRFToken] but takes a [CSRFOpts].
+// Only its Action and Now fields are used.
+func CSRFTokenOpts(s Session, opts CSRFOpts) (string, error) {
+	var buf [csrfTokenLen]byte
 	_, err := rand.Read(buf[:csrfNonceLen])
 	if err != nil {
 		return "", errors.Wrap(err, "generating random nonce")
 	}
-	sum, err := csrfSum(s, buf[:])
+	binary.BigEndian.PutUint64(buf[csrfNonceLen:], uint64(now(opts.Now).Unix()))
+	sum, err := csrfSum(s, buf[:], opts.Action)
 	if err != nil {
 		return "", err
 	}
-	copy(buf[csrfNonceLen:], sum)
+	copy(buf[csrfNonceLen+csrfTimeLen:], sum)
 	return base64.RawURLEncoding.EncodeToString(buf[:]), nil
 }
 
@@ -52,29 +96,61 @@ func CSRFToken(s Session) (string, error) {
 var ErrCSRF = errors.New("CSRF check failed")
 
 // CSRFCheck checks a CSRF token against a session for validity.
-// TODO: check s is active and unexpired?
+// The session must be active and unexpired,
+// and the token must be no older than DefaultCSRFMaxAge.
+//
+// CSRFCheck(s, inp) is the same as CSRFCheckOpts(s, inp, CSRFOpts{}).
 func CSRFCheck(s Session, inp string) error {
+	return CSRFCheckOpts(s, inp, CSRFOpts{})
+}
+
+// csrfMaxSkew is how far in the future a token's timestamp may be,
+// to allow for clock differences among servers.
+const csrfMaxSkew = time.Minute
+
+// CSRFCheckOpts is like [CSRFCheck] but takes a [CSRFOpts].
+func CSRFCheckOpts(s Session, inp string, opts CSRFOpts) error {
+	t := now(opts.Now)
+	if !s.Active() || !t.Before(s.Exp()) {
+		return fmt.Errorf("%w: session inactive or expired", ErrCSRF)
+	}
+
 	got, err := base64.RawURLEncoding.DecodeString(inp)
 	if err != nil {
 		return errors.Wrap(err, "decoding base64")
 	}
-	if len(got) != csrfNonceLen+sha256.Size {
+	if len(got) != csrfTokenLen {
 		return ErrCSRF
 	}
-	want, err := csrfSum(s, got)
+	want, err := csrfSum(s, got, opts.Action)
 	if err != nil {
 		return err
 	}
-	if !hmac.Equal(got[csrfNonceLen:], want) {
+	if !hmac.Equal(got[csrfNonceLen+csrfTimeLen:], want) {
 		return ErrCSRF
 	}
+
+	issued := time.Unix(int64(binary.BigEndian.Uint64(got[csrfNonceLen:])), 0)
+	if issued.After(t.Add(csrfMaxSkew)) {
+		return fmt.Errorf("%w: token issued in the future", ErrCSRF)
+	}
+	if t.Sub(issued) > durationOr(opts.MaxAge, DefaultCSRFMaxAge) {
+		return fmt.Errorf("%w: token expired", ErrCSRF)
+	}
 	return nil
 }
 
-func csrfSum(s Session, inp []byte) ([]byte, error) {
+// csrfSum computes the HMAC, keyed with the session's CSRF key,
+// of the nonce and timestamp at the start of a token,
+// plus the action.
+func csrfSum(s Session, inp []byte, action string) ([]byte, error) {
 	csrfKey := s.CSRFKey()
 	h := hmac.New(sha256.New, csrfKey[:])
-	_, err := h.Write(inp[:csrfNonceLen])
+	_, err := h.Write(inp[:csrfNonceLen+csrfTimeLen])
+	if err != nil {
+		return nil, errors.Wrap(err, "computing HMAC")
+	}
+	_, err = h.Write([]byte(action))
 	if err != nil {
 		return nil, errors.Wrap(err, "computing HMAC")
 	}
@@ -116,26 +192,266 @@ func IsNoSession(err error) bool {
 // If one is found, the request's context is decorated with the session.
 // It can be retrieved by the next handler with [ContextSession].
 // If an active, unexpired session is not found, a 403 Forbidden error is returned.
+// (See [SessionOpts] for alternatives, and [OptionalSession].)
+//
+// If the store is a [SessionSaver] and the session is a [DataSession],
+// the session is saved if the next handler modifies it.
+// The save happens just before the response header is written
+// (or after the next handler returns, if it writes nothing).
+// Changes made after that point are saved when the next handler returns,
+// but cannot update the session cookie,
+// so they are lost with stores whose keys change on saving,
+// such as [CookieSessionStore].
+// Such losses, and failures to save, are logged.
+//
+// SessionHandler(store, cookieName, next) is the same as
+// SessionHandlerOpts(store, SessionOpts{Cookie: CookieOpts{Name: cookieName}}, next).
 func SessionHandler(store SessionStore, cookieName string, next http.Handler) http.Handler {
+	return SessionHandlerOpts(store, SessionOpts{Cookie: CookieOpts{Name: cookieName}}, next)
+}
+
+// SessionOpts are options for [SessionHandlerOpts].
+type SessionOpts struct {
+	// Cookie describes the session cookie.
+	// Its Name field is required.
+	// The other fields are used when the cookie is re-issued.
+	Cookie CookieOpts
+
+	// RenewWithin and Lifetime control sliding expiration.
+	// If both are positive and the store is a [Renewer],
+	// a session within RenewWithin of its expiration time
+	// is renewed to expire Lifetime from now,
+	// and the session cookie is re-issued.
+	RenewWithin, Lifetime time.Duration
+
+	// MaxLifetime, if positive, is the absolute maximum lifetime of a session.
+	// Renewal never extends a session beyond this much time after its creation,
+	// and a session older than this is treated as expired.
+	// It applies only to sessions that are [CreatedSession]s;
+	// other sessions are never renewed when MaxLifetime is set.
+	MaxLifetime time.Duration
+
+	// Optional, if true, passes requests without a valid session
+	// to the next handler unchanged
+	// (so that [ContextSession] returns nil),
+	// instead of rejecting them.
+	// See [OptionalSession].
+	Optional bool
+
+	// Unauthenticated, if non-nil and Optional is false,
+	// handles requests without a valid session
+	// in place of the default 403 Forbidden error.
+	// See [LoginRedirect].
+	Unauthenticated http.Handler
+
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// SessionHandlerOpts is like [SessionHandler] but takes a [SessionOpts].
+func SessionHandlerOpts(store SessionStore, opts SessionOpts, next http.Handler) http.Handler {
 	return Err(func(w http.ResponseWriter, req *http.Request) error {
+		// unauthenticated handles a request lacking a valid session.
+		unauthenticated := func(err error) error {
+			switch {
+			case opts.Optional:
+				next.ServeHTTP(w, req)
+			case opts.Unauthenticated != nil:
+				opts.Unauthenticated.ServeHTTP(w, req)
+			default:
+				return CodeErr{C: http.StatusForbidden, Err: err}
+			}
+			return nil
+		}
+
 		ctx := req.Context()
-		s, err := GetSession(ctx, store, cookieName, req)
+		cookie, err := req.Cookie(opts.Cookie.Name)
+		if errors.Is(err, http.ErrNoCookie) {
+			return unauthenticated(err)
+		}
+		if err != nil {
+			return errors.Wrap(err, "getting session cookie")
+		}
+		s, err := store.Get(ctx, cookie.Value)
 		if IsNoSession(err) {
-			return CodeErr{C: http.StatusForbidden, Err: err}
+			return unauthenticated(err)
 		}
 		if err != nil {
 			return errors.Wrap(err, "getting session")
 		}
-		if !s.Active() || s.Exp().Before(time.Now()) {
-			return CodeErr{C: http.StatusForbidden, Err: fmt.Errorf("session inactive or expired")}
+
+		t := now(opts.Now)
+		if !s.Active() || s.Exp().Before(t) {
+			return unauthenticated(fmt.Errorf("session inactive or expired"))
+		}
+		if cs, ok := s.(CreatedSession); ok && opts.MaxLifetime > 0 && cs.Created().Add(opts.MaxLifetime).Before(t) {
+			return unauthenticated(fmt.Errorf("session exceeded maximum lifetime"))
 		}
+
+		key, s, err := renewSession(ctx, w, store, opts, cookie.Value, s, t)
+		if err != nil {
+			return errors.Wrap(err, "renewing session")
+		}
+
 		ctx = context.WithValue(ctx, sessKeyType{}, s)
 		req = req.WithContext(ctx)
+
+		if saver, ok := store.(SessionSaver); ok {
+			if ds, ok := s.(DataSession); ok {
+				return serveSaving(w, req, saver, opts.Cookie, key, ds, next)
+			}
+		}
+
 		next.ServeHTTP(w, req)
 		return nil
 	})
 }
 
+// OptionalSession is an [http.Handler] middleware wrapper
+// like [SessionHandler],
+// except that a request without an active, unexpired session
+// is passed to the next handler unchanged
+// instead of being rejected.
+// The next handler can tell the difference with [ContextSession],
+// which returns nil in that case.
+// This is useful for pages that render differently for logged-in and anonymous users.
+//
+// OptionalSession(store, cookieName, next) is the same as
+// SessionHandlerOpts(store, SessionOpts{Cookie: CookieOpts{Name: cookieName}, Optional: true}, next).
+func OptionalSession(store SessionStore, cookieName string, next http.Handler) http.Handler {
+	return SessionHandlerOpts(store, SessionOpts{Cookie: CookieOpts{Name: cookieName}, Optional: true}, next)
+}
+
+// LoginRedirect produces a handler suitable for [SessionOpts].Unauthenticated.
+// It redirects browser requests
+// (GET and HEAD requests that accept text/html)
+// to loginURL,
+// with a "next" query parameter holding the requested URL's path and query,
+// so the login page can send the user back after logging in.
+// (The login page should check that the value of "next" is a local path
+// before redirecting to it.)
+// Other requests get a 403 Forbidden error,
+// as they would without LoginRedirect.
+// (Not 401 Unauthorized,
+// which requires a WWW-Authenticate challenge
+// that cookie-based sessions cannot supply.)
+func LoginRedirect(loginURL string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		isBrowser := (req.Method == http.MethodGet || req.Method == http.MethodHead) && strings.Contains(req.Header.Get("Accept"), "text/html")
+		if !isBrowser {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		u, err := url.Parse(loginURL)
+		if err != nil {
+			http.Error(w, "bad login URL", http.StatusInternalServerError)
+			return
+		}
+		q := u.Query()
+		q.Set("next", req.URL.RequestURI())
+		u.RawQuery = q.Encode()
+		http.Redirect(w, req, u.String(), http.StatusSeeOther)
+	})
+}
+
+// Renewer is a [SessionStore] that can extend the lifetime of sessions.
+// See [SessionOpts].
+type Renewer interface {
+	SessionStore
+
+	// Renew changes the expiration time of the session with the given key.
+	// It returns the session's key,
+	// which may differ from the given one,
+	// and the updated session.
+	Renew(ctx context.Context, key string, exp time.Time) (string, Session, error)
+}
+
+// Rotator is a [SessionStore] that can change the keys of sessions.
+// Rotating a session's key after login or privilege elevation
+// defends against session fixation attacks.
+// See [RotateSession].
+type Rotator interface {
+	SessionStore
+
+	// Rotate gives the session with the given key a new random key and a new CSRF key.
+	// The old key continues to refer to the session for the given grace period,
+	// so that requests already in flight with it are not disrupted,
+	// and then becomes invalid.
+	// During the grace period,
+	// Get with the old key returns the session with its old CSRF key,
+	// so that CSRF tokens made before the rotation still pass [CSRFCheck]
+	// in requests using the old key.
+	// Rotate returns the new key and the updated session.
+	Rotate(ctx context.Context, oldKey string, grace time.Duration) (string, Session, error)
+}
+
+// RotateSession rotates the key of the session identified by the session cookie in req
+// (see [Rotator])
+// and sets the session cookie in the response to the new key.
+// It should be called before anything is written to w.
+//
+// The returned session has a new CSRF key,
+// so CSRF tokens must be regenerated from it.
+// Tokens made from the old CSRF key remain valid
+// only in requests using the old session key,
+// and only during the grace period.
+// The session in the request context (see [ContextSession]) is not updated.
+func RotateSession(w http.ResponseWriter, req *http.Request, store Rotator, opts CookieOpts, grace time.Duration) (Session, error) {
+	cookie, err := req.Cookie(opts.Name)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting session cookie")
+	}
+	key, s, err := store.Rotate(req.Context(), cookie.Value, grace)
+	if err != nil {
+		return nil, errors.Wrap(err, "rotating session key")
+	}
+	SetSessionCookie(w, opts, key, s.Exp())
+	return s, nil
+}
+
+// CreatedSession is a [Session] that knows its creation time.
+type CreatedSession interface {
+	Session
+
+	// Created is the creation time of the session.
+	Created() time.Time
+}
+
+// renewSession renews s if opts and store permit and it is due.
+// It returns the key and the renewed session,
+// or key and s themselves if no renewal was done.
+func renewSession(ctx context.Context, w http.ResponseWriter, store SessionStore, opts SessionOpts, key string, s Session, t time.Time) (string, Session, error) {
+	renewer, ok := store.(Renewer)
+	if !ok || opts.RenewWithin <= 0 || opts.Lifetime <= 0 {
+		return key, s, nil
+	}
+	if s.Exp().Sub(t) >= opts.RenewWithin {
+		return key, s, nil
+	}
+
+	exp := t.Add(opts.Lifetime)
+	if opts.MaxLifetime > 0 {
+		cs, ok := s.(CreatedSession)
+		if !ok {
+			return key, s, nil
+		}
+		if limit := cs.Created().Add(opts.MaxLifetime); exp.After(limit) {
+			exp = limit
+		}
+	}
+	if !exp.After(s.Exp()) {
+		return key, s, nil
+	}
+
+	key, s, err := renewer.Renew(ctx, key, exp)
+	if err != nil {
+		return "", nil, err
+	}
+	SetSessionCookie(w, opts.Cookie, key, exp)
+	return key, s, nil
+}
+
 type sessKeyType struct{}
 
 // ContextSession returns the [Session] associated with a context (by [SessionHandler]), if there is one.
@@ -144,3 +460,107 @@ func ContextSession(ctx context.Context) Session {
 	s, _ := ctx.Value(sessKeyType{}).(Session)
 	return s
 }
+
+// SessionCreator is a [SessionStore] that can create new sessions.
+type SessionCreator interface {
+	SessionStore
+
+	// Create creates a new, active session expiring at the given time,
+	// with a fresh random key and CSRF key.
+	// It returns the session's key and the session.
+	Create(context.Context, time.Time) (string, Session, error)
+}
+
+// CookieOpts are options for the session cookie
+// set by [StartSession] and cleared by [EndSession].
+// The zero values of its fields other than Name produce secure defaults.
+type CookieOpts struct {
+	// Name is the name of the cookie.
+	Name string
+
+	// Path is the cookie's path attribute.
+	// If this is "", "/" is used.
+	Path string
+
+	// Domain is the cookie's domain attribute.
+	// If this is "", the cookie is a host-only cookie.
+	Domain string
+
+	// Insecure, if true, omits the cookie's Secure attribute,
+	// allowing it to be sent over plain HTTP.
+	// This is useful only in development.
+	Insecure bool
+
+	// SameSite is the cookie's SameSite attribute.
+	// If this is zero, [http.SameSiteLaxMode] is used.
+	SameSite http.SameSite
+}
+
+func (opts CookieOpts) cookie(value string) *http.Cookie {
+	c := &http.Cookie{
+		Name:     opts.Name,
+		Value:    value,
+		Path:     opts.Path,
+		Domain:   opts.Domain,
+		Secure:   !opts.Insecure,
+		HttpOnly: true,
+		SameSite: opts.SameSite,
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if c.SameSite == 0 {
+		c.SameSite = http.SameSiteLaxMode
+	}
+	return c
+}
+
+// SetSessionCookie sets a cookie in the response
+// holding the given session key
+// and lasting until the given expiration time.
+// The cookie is HttpOnly,
+// and other attributes are determined by opts.
+func SetSessionCookie(w http.ResponseWriter, opts CookieOpts, key string, exp time.Time) {
+	c := opts.cookie(key)
+	c.Expires = exp
+	c.MaxAge = max(int(time.Until(exp).Round(time.Second)/time.Second), 1)
+	http.SetCookie(w, c)
+}
+
+// ClearSessionCookie sets a cookie in the response
+// that tells the client to discard its session cookie.
+func ClearSessionCookie(w http.ResponseWriter, opts CookieOpts) {
+	c := opts.cookie("")
+	c.MaxAge = -1
+	http.SetCookie(w, c)
+}
+
+// StartSession creates a new session in the given store
+// and sets the session cookie in the response.
+// It should be called after the user logs in,
+// and before anything is written to w.
+func StartSession(ctx context.Context, w http.ResponseWriter, store SessionCreator, opts CookieOpts, exp time.Time) (Session, error) {
+	key, s, err := store.Create(ctx, exp)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating session")
+	}
+	SetSessionCookie(w, opts, key, exp)
+	return s, nil
+}
+
+// EndSession cancels the session identified by the session cookie in req, if there is one,
+// and clears the cookie.
+// It should be called when the user logs out,
+// and before anything is written to w.
+func EndSession(w http.ResponseWriter, req *http.Request, store SessionStore, opts CookieOpts) error {
+	ClearSessionCookie(w, opts)
+
+	cookie, err := req.Cookie(opts.Name)
+	if errors.Is(err, http.ErrNoCookie) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "getting session cookie")
+	}
+	return errors.Wrap(store.Cancel(req.Context(), cookie.Value), "canceling session")
+}
@@ -47,6 +47,64 @@ func TestCSRF(t *testing.T) {
 	}
 }
 
+func TestCSRFOpts(t *testing.T) {
+	var (
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		s     testSession
+	)
+
+	tok, err := CSRFTokenOpts(s, CSRFOpts{Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(time.Hour)
+	if err := CSRFCheckOpts(s, tok, CSRFOpts{Now: clock.Now}); err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+	if err := CSRFCheckOpts(s, tok, CSRFOpts{MaxAge: time.Minute, Now: clock.Now}); !errors.Is(err, ErrCSRF) {
+		t.Errorf("got error %v for old token, want %s", err, ErrCSRF)
+	}
+
+	// Tokens from the future are rejected.
+	if err := CSRFCheckOpts(s, tok, CSRFOpts{Now: func() time.Time { return time.Unix(1000000, 0).Add(-time.Hour) }}); !errors.Is(err, ErrCSRF) {
+		t.Errorf("got error %v for future token, want %s", err, ErrCSRF)
+	}
+
+	action := CSRFAction("post", "/transfer")
+	if action != "POST /transfer" {
+		t.Errorf("got action %q, want %q", action, "POST /transfer")
+	}
+	tok, err = CSRFTokenOpts(s, CSRFOpts{Action: action, Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CSRFCheckOpts(s, tok, CSRFOpts{Action: action, Now: clock.Now}); err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+	for _, other := range []string{"", CSRFAction("POST", "/delete")} {
+		if err := CSRFCheckOpts(s, tok, CSRFOpts{Action: other, Now: clock.Now}); !errors.Is(err, ErrCSRF) {
+			t.Errorf("got error %v checking token for action %q, want %s", err, other, ErrCSRF)
+		}
+	}
+
+	bs, err := NewBasicSession(clock.Now(), clock.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok, err = CSRFTokenOpts(bs, CSRFOpts{Now: clock.Now}); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(2 * time.Hour)
+	if err := CSRFCheckOpts(bs, tok, CSRFOpts{Now: clock.Now}); !errors.Is(err, ErrCSRF) {
+		t.Errorf("got error %v for expired session, want %s", err, ErrCSRF)
+	}
+	bs.exp = clock.Now().Add(time.Hour)
+	bs.canceled = true
+	if err := CSRFCheckOpts(bs, tok, CSRFOpts{Now: clock.Now}); !errors.Is(err, ErrCSRF) {
+		t.Errorf("got error %v for canceled session, want %s", err, ErrCSRF)
+	}
+}
+
 func TestSessionHandler(t *testing.T) {
 	var (
 		store testSessionStore
@@ -116,3 +174,244 @@ func (s testSessionStore) Get(_ context.Context, key string) (Session, error) {
 func (testSessionStore) Cancel(context.Context, string) error {
 	return fmt.Errorf("unimplemented")
 }
+
+func TestStartEndSession(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = &MemSessionStore{}
+		opts  = CookieOpts{Name: "session"}
+		exp   = time.Now().Add(time.Hour)
+	)
+
+	rec := httptest.NewRecorder()
+	if _, err := StartSession(ctx, rec, store, opts, exp); err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want 1", len(cookies))
+	}
+	c := cookies[0]
+	if c.Name != "session" || c.Path != "/" || !c.Secure || !c.HttpOnly || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("got cookie %s, want secure defaults", c)
+	}
+	if c.MaxAge < 3590 || c.MaxAge > 3600 {
+		t.Errorf("got Max-Age %d, want about 3600", c.MaxAge)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+	if _, err := GetSession(ctx, store, "session", req); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = httptest.NewRecorder()
+	if err := EndSession(rec, req, store, opts); err != nil {
+		t.Fatal(err)
+	}
+	cookies = rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "session" || cookies[0].MaxAge >= 0 {
+		t.Errorf("got cookies %v, want session cookie cleared", cookies)
+	}
+	s, err := GetSession(ctx, store, "session", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Active() {
+		t.Error("session still active after EndSession")
+	}
+
+	// Ending a nonexistent session is not an error.
+	if err := EndSession(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), store, opts); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRotateSession(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = &MemSessionStore{}
+		opts  = CookieOpts{Name: "session"}
+	)
+	oldKey, _, err := store.Create(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/login", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: oldKey})
+	rec := httptest.NewRecorder()
+	s, err := RotateSession(rec, req, store, opts, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "session" {
+		t.Fatalf("got cookies %v, want one session cookie", cookies)
+	}
+	newKey := cookies[0].Value
+	if newKey == oldKey {
+		t.Error("session cookie not changed")
+	}
+	got, err := store.Get(ctx, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CSRFKey() != s.CSRFKey() {
+		t.Error("cookie does not refer to rotated session")
+	}
+
+	if _, err := RotateSession(httptest.NewRecorder(), req, store, opts, 0); !errors.Is(err, ErrNoSession) {
+		t.Errorf("got error %v rotating old key, want %v", err, ErrNoSession)
+	}
+	if _, err := RotateSession(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), store, opts, 0); err == nil {
+		t.Error("got no error rotating without a cookie")
+	}
+}
+
+func TestSessionRenewal(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		clock = &fakeClock{t: time.Now()}
+		start = clock.Now()
+		store = &MemSessionStore{Now: clock.Now}
+		opts  = SessionOpts{
+			Cookie:      CookieOpts{Name: "session"},
+			RenewWithin: 30 * time.Minute,
+			Lifetime:    time.Hour,
+			MaxLifetime: 2 * time.Hour,
+			Now:         clock.Now,
+		}
+	)
+
+	key, _, err := store.Create(ctx, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := SessionHandlerOpts(store, opts, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	cases := []struct {
+		at         time.Duration
+		wantStatus int
+		wantExp    time.Duration // zero means no renewal
+	}{{
+		at:         10 * time.Minute,
+		wantStatus: http.StatusNoContent,
+	}, {
+		at:         40 * time.Minute,
+		wantStatus: http.StatusNoContent,
+		wantExp:    100 * time.Minute,
+	}, {
+		at:         90 * time.Minute,
+		wantStatus: http.StatusNoContent,
+		wantExp:    120 * time.Minute,
+	}, {
+		at:         110 * time.Minute,
+		wantStatus: http.StatusNoContent,
+	}, {
+		at:         121 * time.Minute,
+		wantStatus: http.StatusForbidden,
+	}}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("case_%02d", i+1), func(t *testing.T) {
+			clock.mu.Lock()
+			clock.t = start.Add(tc.at)
+			clock.mu.Unlock()
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.AddCookie(&http.Cookie{Name: "session", Value: key})
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tc.wantStatus)
+			}
+
+			cookies := rec.Result().Cookies()
+			if tc.wantExp == 0 {
+				if len(cookies) != 0 {
+					t.Errorf("got cookies %v, want none", cookies)
+				}
+				return
+			}
+			if len(cookies) != 1 || cookies[0].Value != key {
+				t.Fatalf("got cookies %v, want renewed session cookie", cookies)
+			}
+			s, err := store.Get(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := s.Exp(), start.Add(tc.wantExp); !got.Equal(want) {
+				t.Errorf("got expiration %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestOptionalSession(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = &MemSessionStore{}
+	)
+	key, _, err := store.Create(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := OptionalSession(store, "session", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ContextSession(req.Context()) != nil {
+			fmt.Fprint(w, "logged in")
+		} else {
+			fmt.Fprint(w, "anonymous")
+		}
+	}))
+
+	for _, tc := range []struct {
+		cookie, want string
+	}{
+		{"", "anonymous"},
+		{"bogus", "anonymous"},
+		{key, "logged in"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "session", Value: tc.cookie})
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != tc.want {
+			t.Errorf("cookie %q: got %d %q, want %d %q", tc.cookie, rec.Code, rec.Body.String(), http.StatusOK, tc.want)
+		}
+	}
+}
+
+func TestLoginRedirect(t *testing.T) {
+	h := SessionHandlerOpts(&MemSessionStore{}, SessionOpts{
+		Cookie:          CookieOpts{Name: "session"},
+		Unauthenticated: LoginRedirect("/login?lang=en"),
+	}, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Error("next handler called without a session")
+	}))
+
+	req := httptest.NewRequest("GET", "/account?tab=2", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	if got, want := rec.Header().Get("Location"), "/login?lang=en&next=%2Faccount%3Ftab%3D2"; got != want {
+		t.Errorf("got Location %q, want %q", got, want)
+	}
+
+	req = httptest.NewRequest("GET", "/api/account", nil)
+	req.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d for API request, want %d", rec.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,177 @@
+package mid
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/bobg/errors"
+)
+
+// DataSession is a [Session] that can hold application data,
+// such as the ID of the logged-in user.
+// Values are stored by name and must be JSON-marshalable.
+//
+// When the store used by [SessionHandler] is a [SessionSaver],
+// a DataSession that has been modified during a request
+// is saved automatically.
+type DataSession interface {
+	Session
+
+	// Get decodes the value with the given name into ptr,
+	// which must be a pointer.
+	// It reports whether the value was present.
+	Get(name string, ptr any) (bool, error)
+
+	// Set sets the value with the given name.
+	Set(name string, val any) error
+
+	// Delete removes the value with the given name, if it is present.
+	Delete(name string)
+
+	// Dirty tells whether the session's data has been modified since it was loaded or last saved.
+	Dirty() bool
+
+	// MarkSaved clears the dirty flag.
+	// It is called after the session is saved.
+	MarkSaved()
+}
+
+// SessionSaver is a [SessionStore] that can save modifications to a [DataSession].
+type SessionSaver interface {
+	SessionStore
+
+	// Save stores the data of the given session under the given key.
+	// It returns the session's key,
+	// which may differ from the given one.
+	Save(ctx context.Context, key string, s Session) (string, error)
+}
+
+// SessionValue gets the value with the given name from a [DataSession].
+// It reports whether the value was present.
+func SessionValue[T any](s DataSession, name string) (T, bool, error) {
+	var val T
+	ok, err := s.Get(name, &val)
+	return val, ok, err
+}
+
+// flashName is the name of the session value holding flash messages.
+const flashName = "_flash"
+
+// AddFlash adds a one-shot message to a session,
+// to be retrieved by [Flashes] in a later request,
+// typically after a redirect.
+func AddFlash(s DataSession, msg string) error {
+	var msgs []string
+	if _, err := s.Get(flashName, &msgs); err != nil {
+		return err
+	}
+	return s.Set(flashName, append(msgs, msg))
+}
+
+// Flashes returns the messages added with [AddFlash]
+// and removes them from the session.
+func Flashes(s DataSession) ([]string, error) {
+	var msgs []string
+	ok, err := s.Get(flashName, &msgs)
+	if err != nil || !ok {
+		return nil, err
+	}
+	s.Delete(flashName)
+	return msgs, nil
+}
+
+// sessionSaveWriter is a ResponseWrapper
+// that saves a modified session just before the response header is written,
+// so that a changed session key can be sent in the session cookie.
+// If that save fails,
+// the response is 500 Internal Server Error instead,
+// and the handler's writes are discarded.
+type sessionSaveWriter struct {
+	ResponseWrapper
+	ctx     context.Context
+	store   SessionSaver
+	opts    CookieOpts
+	key     string
+	s       DataSession
+	written bool
+	err     error
+}
+
+func (sw *sessionSaveWriter) WriteHeader(code int) {
+	if sw.commit() {
+		sw.ResponseWrapper.WriteHeader(code)
+	}
+}
+
+func (sw *sessionSaveWriter) Write(b []byte) (int, error) {
+	if !sw.commit() {
+		return 0, sw.err
+	}
+	return sw.ResponseWrapper.Write(b)
+}
+
+// commit saves the session the first time it is called,
+// responding with an error if that fails.
+// It reports whether the handler's response may proceed.
+func (sw *sessionSaveWriter) commit() bool {
+	if !sw.written {
+		sw.written = true
+		sw.save()
+		if sw.err != nil {
+			Errf(&sw.ResponseWrapper, http.StatusInternalServerError, "%s", sw.err)
+		}
+	}
+	return sw.err == nil
+}
+
+// save saves the session if it is dirty.
+// The session cookie is re-issued if the key changes,
+// which works only before the response header is written.
+func (sw *sessionSaveWriter) save() {
+	if sw.err != nil || !sw.s.Dirty() {
+		return
+	}
+	key, err := sw.store.Save(sw.ctx, sw.key, sw.s)
+	if err != nil {
+		sw.err = errors.Wrap(err, "saving session")
+		return
+	}
+	sw.s.MarkSaved()
+	if key != sw.key {
+		sw.key = key
+		SetSessionCookie(sw.W, sw.opts, key, sw.s.Exp())
+	}
+}
+
+// serveSaving serves req with next,
+// saving s in store if it is modified.
+// A failure to save after the response header has been written,
+// or to send a changed session key,
+// can only be logged.
+func serveSaving(w http.ResponseWriter, req *http.Request, store SessionSaver, opts CookieOpts, key string, s DataSession, next http.Handler) error {
+	sw := &sessionSaveWriter{
+		ResponseWrapper: ResponseWrapper{W: w},
+		ctx:             req.Context(),
+		store:           store,
+		opts:            opts,
+		key:             key,
+		s:               s,
+	}
+	next.ServeHTTP(sw, req)
+	if !sw.written {
+		sw.save()
+		return sw.err
+	}
+	if sw.err == nil {
+		oldKey := sw.key
+		sw.save()
+		switch {
+		case sw.err != nil:
+			log.Printf("%s (after response header was written)", sw.err)
+		case sw.key != oldKey:
+			log.Print("session changed after response header was written; new session key not sent")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package mid
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBasicSessionData(t *testing.T) {
+	s, err := NewBasicSession(time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Dirty() {
+		t.Error("new session is dirty")
+	}
+
+	if err := s.Set("user", 17); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Dirty() {
+		t.Error("session not dirty after Set")
+	}
+	s.MarkSaved()
+
+	user, ok, err := SessionValue[int](s, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || user != 17 {
+		t.Errorf("got %d, %v; want 17, true", user, ok)
+	}
+	if _, ok, err := SessionValue[int](s, "bogus"); err != nil || ok {
+		t.Errorf("got %v, %v for missing value; want false, nil", ok, err)
+	}
+	if _, _, err := SessionValue[string](s, "user"); err == nil {
+		t.Error("got no error decoding value into the wrong type")
+	}
+
+	c := s.clone()
+	s.Delete("bogus")
+	if s.Dirty() {
+		t.Error("session dirty after deleting missing value")
+	}
+	s.Delete("user")
+	if !s.Dirty() {
+		t.Error("session not dirty after Delete")
+	}
+	if _, ok, _ := SessionValue[int](s, "user"); ok {
+		t.Error("value present after Delete")
+	}
+	if _, ok, _ := SessionValue[int](c, "user"); !ok {
+		t.Error("Delete affected clone")
+	}
+}
+
+func TestFlashes(t *testing.T) {
+	s, err := NewBasicSession(time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"saved", "welcome back"} {
+		if err := AddFlash(s, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := Flashes(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"saved", "welcome back"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	got, err = Flashes(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("got %v on second call, want none", got)
+	}
+}
+
+// countingSaver is a MemSessionStore that counts saves
+// and optionally gives sessions a new key on each save.
+type countingSaver struct {
+	*MemSessionStore
+	saves  int
+	rekey  bool
+	rekeys map[string]string // new key -> underlying key
+}
+
+func (cs *countingSaver) Save(ctx context.Context, key string, s Session) (string, error) {
+	cs.saves++
+	if k, ok := cs.rekeys[key]; ok {
+		key = k
+	}
+	key, err := cs.MemSessionStore.Save(ctx, key, s)
+	if err != nil || !cs.rekey {
+		return key, err
+	}
+	newKey := key + "x"
+	if cs.rekeys == nil {
+		cs.rekeys = make(map[string]string)
+	}
+	cs.rekeys[newKey] = key
+	return newKey, nil
+}
+
+func (cs *countingSaver) Get(ctx context.Context, key string) (Session, error) {
+	if k, ok := cs.rekeys[key]; ok {
+		key = k
+	}
+	return cs.MemSessionStore.Get(ctx, key)
+}
+
+func TestSessionHandlerSave(t *testing.T) {
+	for _, rekey := range []bool{false, true} {
+		t.Run(map[bool]string{false: "samekey", true: "rekey"}[rekey], func(t *testing.T) {
+			var (
+				ctx   = context.Background()
+				store = &countingSaver{MemSessionStore: &MemSessionStore{}, rekey: rekey}
+			)
+			key, _, err := store.Create(ctx, time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := SessionHandler(store, "session", Err(func(w http.ResponseWriter, req *http.Request) error {
+				s := ContextSession(req.Context()).(DataSession)
+				switch req.URL.Path {
+				case "/set":
+					if err := s.Set("user", "alice"); err != nil {
+						return err
+					}
+					_, err := w.Write([]byte("ok"))
+					return err
+				case "/get":
+					user, _, err := SessionValue[string](s, "user")
+					if err != nil {
+						return err
+					}
+					_, err = w.Write([]byte(user))
+					return err
+				}
+				return nil
+			}))
+
+			do := func(path string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("GET", path, nil)
+				req.AddCookie(&http.Cookie{Name: "session", Value: key})
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s: got status %d, want %d", path, rec.Code, http.StatusOK)
+				}
+				return rec
+			}
+
+			rec := do("/set")
+			if store.saves != 1 {
+				t.Errorf("got %d saves, want 1", store.saves)
+			}
+			cookies := rec.Result().Cookies()
+			if rekey {
+				if len(cookies) != 1 || cookies[0].Value == key {
+					t.Fatalf("got cookies %v, want new session cookie", cookies)
+				}
+				key = cookies[0].Value
+			} else if len(cookies) != 0 {
+				t.Errorf("got cookies %v, want none", cookies)
+			}
+
+			rec = do("/get")
+			if got := rec.Body.String(); got != "alice" {
+				t.Errorf("got %q, want alice", got)
+			}
+			if store.saves != 1 {
+				t.Errorf("got %d saves after unmodifying request, want 1", store.saves)
+			}
+		})
+	}
+}
+
+// failingSaver is a MemSessionStore whose saves fail.
+type failingSaver struct {
+	*MemSessionStore
+}
+
+func (failingSaver) Save(context.Context, string, Session) (string, error) {
+	return "", errors.New("disk full")
+}
+
+func TestSessionHandlerSaveError(t *testing.T) {
+	store := failingSaver{MemSessionStore: &MemSessionStore{}}
+	key, _, err := store.Create(context.Background(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := SessionHandler(store, "session", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s := ContextSession(req.Context()).(DataSession)
+		if req.URL.Path == "/late" {
+			w.WriteHeader(http.StatusCreated)
+		}
+		if err := s.Set("user", "alice"); err != nil {
+			t.Fatal(err)
+		}
+		if req.URL.Path == "/" {
+			w.WriteHeader(http.StatusCreated)
+		}
+		if req.URL.Path != "/silent" {
+			w.Write([]byte("ok"))
+		}
+	}))
+
+	cases := []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{path: "/", wantStatus: http.StatusInternalServerError},
+		{path: "/silent", wantStatus: http.StatusInternalServerError},
+		{path: "/late", wantStatus: http.StatusCreated, wantBody: "ok"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: key})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.path, rec.Code, tc.wantStatus)
+		}
+		if got := rec.Body.String(); (tc.wantBody != "" && got != tc.wantBody) || (tc.wantBody == "" && strings.Contains(got, "ok")) {
+			t.Errorf("%s: got body %q", tc.path, got)
+		}
+	}
+}
+
+func TestSessionHandlerSaveAfterHeader(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = &countingSaver{MemSessionStore: &MemSessionStore{}, rekey: true}
+	)
+	key, _, err := store.Create(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := SessionHandler(store, "session", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+		if err := ContextSession(req.Context()).(DataSession).Set("user", "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}))
+
+	logged := new(bytes.Buffer)
+	log.SetOutput(logged)
+	defer log.SetOutput(os.Stderr)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: key})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if store.saves != 1 {
+		t.Errorf("got %d saves, want 1", store.saves)
+	}
+	if cookies := rec.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("got cookies %v, want none", cookies)
+	}
+	if !strings.Contains(logged.String(), "new session key not sent") {
+		t.Errorf("lost session change not logged; log is %q", logged.String())
+	}
+}
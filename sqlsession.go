@@ -0,0 +1,466 @@
+package mid
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bobg/errors"
+)
+
+// SQLSessionStore is a [SessionStore] that keeps sessions in a SQL database
+// via [database/sql].
+// Its sessions are of type [*BasicSession].
+//
+// Sessions are stored in a single table
+// (named "sessions" by default)
+// with this schema:
+//
+//	CREATE TABLE sessions (
+//	  id VARCHAR(64) PRIMARY KEY, -- SHA-256 hash of the session key, in hex
+//	  csrf_key VARCHAR(64) NOT NULL, -- in hex
+//	  created BIGINT NOT NULL, -- Unix time in nanoseconds
+//	  exp BIGINT NOT NULL, -- Unix time in nanoseconds
+//	  canceled INTEGER NOT NULL,
+//	  data TEXT, -- JSON object of session values (see DataSession)
+//	  alias VARCHAR(64) -- for the old key of a rotated session, the masked new key
+//	);
+//	CREATE INDEX sessions_exp ON sessions (exp);
+//	CREATE INDEX sessions_canceled ON sessions (canceled);
+//
+// [SQLSessionStore.Migrate] creates this table,
+// plus a table (named "sessions_version" by default)
+// recording the schema version for future migrations.
+// Session keys are not stored in the clear.
+//
+// Expired and canceled sessions are discarded by [SQLSessionStore.Purge].
+type SQLSessionStore struct {
+	DB *sql.DB
+
+	// Table is the name of the sessions table.
+	// It is interpolated into SQL statements and must be a trusted identifier.
+	// If this is "", "sessions" is used.
+	Table string
+
+	// Placeholder, if non-nil, produces the placeholder for the nth argument (counting from 1)
+	// of a SQL statement.
+	// By default "?" is used,
+	// which is right for SQLite and MySQL.
+	// For PostgreSQL use [DollarPlaceholder].
+	Placeholder func(n int) string
+
+	// MigrateLock, if non-nil, is called by [SQLSessionStore.Migrate]
+	// to serialize migrations among processes sharing the database.
+	// It should acquire a lock that is held by the given connection
+	// (such as PostgreSQL's pg_advisory_lock or MySQL's GET_LOCK),
+	// and return a function releasing it.
+	// Migrate performs the migration on the same connection.
+	MigrateLock func(ctx context.Context, conn *sql.Conn) (unlock func() error, err error)
+
+	// Now is the clock. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// DollarPlaceholder produces PostgreSQL-style placeholders ($1, $2, ...)
+// for [SQLSessionStore].
+func DollarPlaceholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+var (
+	_ SessionCreator = &SQLSessionStore{}
+	_ Renewer        = &SQLSessionStore{}
+	_ Rotator        = &SQLSessionStore{}
+	_ SessionSaver   = &SQLSessionStore{}
+)
+
+// sqlSessionMigrations are the statements that bring the schema from version n to version n+1.
+// The table name is substituted for %[1]s.
+var sqlSessionMigrations = [][]string{
+	{
+		`CREATE TABLE %[1]s (id VARCHAR(64) PRIMARY KEY, csrf_key VARCHAR(64) NOT NULL, created BIGINT NOT NULL, exp BIGINT NOT NULL, canceled INTEGER NOT NULL, data TEXT, alias VARCHAR(64))`,
+		`CREATE INDEX %[1]s_exp ON %[1]s (exp)`,
+		`CREATE INDEX %[1]s_canceled ON %[1]s (canceled)`,
+	},
+}
+
+// Migrate creates or updates the tables used by the store.
+// It may be called on every startup,
+// but if several processes may call it at once
+// (e.g. the replicas of a service),
+// MigrateLock must be set,
+// or else the calls may conflict and fail.
+//
+// Each migration runs in a transaction,
+// but on databases where schema changes commit implicitly (such as MySQL),
+// a migration that fails partway may need to be repaired by hand.
+func (s *SQLSessionStore) Migrate(ctx context.Context) (err error) {
+	versionTable := s.table() + "_version"
+
+	conn, err := s.DB.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "getting database connection")
+	}
+	defer conn.Close()
+
+	if s.MigrateLock != nil {
+		unlock, lockErr := s.MigrateLock(ctx, conn)
+		if lockErr != nil {
+			return errors.Wrap(lockErr, "locking for migration")
+		}
+		defer func() {
+			if unlockErr := unlock(); err == nil {
+				err = errors.Wrap(unlockErr, "unlocking after migration")
+			}
+		}()
+	}
+
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (version INTEGER NOT NULL)`, versionTable)); err != nil {
+		return errors.Wrap(err, "creating version table")
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	var version int
+	err = tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT version FROM %s`, versionTable)).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := tx.ExecContext(ctx, s.bind(fmt.Sprintf(`INSERT INTO %s (version) VALUES (?)`, versionTable)), 0); err != nil {
+			return errors.Wrap(err, "initializing version table")
+		}
+	} else if err != nil {
+		return errors.Wrap(err, "getting schema version")
+	}
+
+	if version >= len(sqlSessionMigrations) {
+		return nil
+	}
+	for i, stmts := range sqlSessionMigrations[version:] {
+		for _, stmt := range stmts {
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(stmt, s.table())); err != nil {
+				return errors.Wrapf(err, "migrating to version %d", version+i+1)
+			}
+		}
+	}
+	if _, err := tx.ExecContext(ctx, s.bind(fmt.Sprintf(`UPDATE %s SET version = ?`, versionTable)), len(sqlSessionMigrations)); err != nil {
+		return errors.Wrap(err, "updating schema version")
+	}
+	return errors.Wrap(tx.Commit(), "committing migration")
+}
+
+// Create implements [SessionCreator].
+func (s *SQLSessionStore) Create(ctx context.Context, exp time.Time) (string, Session, error) {
+	key, err := NewSessionKey()
+	if err != nil {
+		return "", nil, err
+	}
+	sess, err := NewBasicSession(now(s.Now), exp)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := s.insert(ctx, s.DB, key, sess); err != nil {
+		return "", nil, err
+	}
+	return key, sess, nil
+}
+
+// Get implements [SessionStore].
+// It returns [ErrNoSession] for expired sessions.
+func (s *SQLSessionStore) Get(ctx context.Context, key string) (Session, error) {
+	_, sess, oldCSRFKey, err := s.resolve(ctx, s.DB, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(oldCSRFKey) == len(sess.csrfKey) {
+		copy(sess.csrfKey[:], oldCSRFKey)
+	}
+	return sess, nil
+}
+
+// Cancel implements [SessionStore].
+func (s *SQLSessionStore) Cancel(ctx context.Context, key string) error {
+	key, _, _, err := s.resolve(ctx, s.DB, key)
+	if errors.Is(err, ErrNoSession) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.ExecContext(ctx, s.query(`UPDATE %s SET canceled = 1 WHERE id = ?`), hashSessionKey(key))
+	return errors.Wrap(err, "canceling session")
+}
+
+// Renew implements [Renewer].
+// The key does not change,
+// unless the given key is the old key of a rotated session
+// (see [SQLSessionStore.Rotate]),
+// in which case the new key is returned.
+func (s *SQLSessionStore) Renew(ctx context.Context, key string, exp time.Time) (string, Session, error) {
+	key, sess, _, err := s.resolve(ctx, s.DB, key)
+	if err != nil {
+		return "", nil, err
+	}
+	sess.exp = exp
+	if _, err := s.DB.ExecContext(ctx, s.query(`UPDATE %s SET exp = ? WHERE id = ?`), exp.UnixNano(), hashSessionKey(key)); err != nil {
+		return "", nil, errors.Wrap(err, "renewing session")
+	}
+	return key, sess, nil
+}
+
+// Rotate implements [Rotator].
+// The old key's row keeps the session's CSRF key from before rotation.
+func (s *SQLSessionStore) Rotate(ctx context.Context, oldKey string, grace time.Duration) (string, Session, error) {
+	newKey, err := NewSessionKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	oldKey, sess, _, err := s.resolve(ctx, tx, oldKey)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := sess.newCSRFKey(); err != nil {
+		return "", nil, err
+	}
+	if err := s.insert(ctx, tx, newKey, sess); err != nil {
+		return "", nil, err
+	}
+
+	if grace <= 0 {
+		_, err = tx.ExecContext(ctx, s.query(`DELETE FROM %s WHERE id = ?`), hashSessionKey(oldKey))
+	} else {
+		var alias []byte
+		if alias, err = maskSessionKey(oldKey, newKey); err != nil {
+			return "", nil, err
+		}
+		until := now(s.Now).Add(grace)
+		_, err = tx.ExecContext(ctx, s.query(`UPDATE %s SET data = NULL, exp = ?, alias = ? WHERE id = ?`), until.UnixNano(), hex.EncodeToString(alias), hashSessionKey(oldKey))
+	}
+	if err != nil {
+		return "", nil, errors.Wrap(err, "retiring old session key")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", nil, errors.Wrap(err, "committing transaction")
+	}
+	return newKey, sess, nil
+}
+
+// Save implements [SessionSaver].
+// The session must be a [*BasicSession].
+// Only its data is saved.
+func (s *SQLSessionStore) Save(ctx context.Context, key string, sess Session) (string, error) {
+	bs, ok := sess.(*BasicSession)
+	if !ok {
+		return "", errors.Newf("cannot save session of type %T", sess)
+	}
+	key, _, _, err := s.resolve(ctx, s.DB, key)
+	if err != nil {
+		return "", err
+	}
+	data, err := sqlSessionData(bs)
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.DB.ExecContext(ctx, s.query(`UPDATE %s SET data = ? WHERE id = ?`), data, hashSessionKey(key)); err != nil {
+		return "", errors.Wrap(err, "saving session")
+	}
+	return key, nil
+}
+
+// Purge discards expired and canceled sessions,
+// and the expired old keys of rotated sessions.
+// It returns the number of rows deleted.
+func (s *SQLSessionStore) Purge(ctx context.Context) (int, error) {
+	// Separate statements, rather than one with OR,
+	// so that each can use its index.
+	var total int64
+	for _, q := range []struct {
+		stmt string
+		args []any
+	}{
+		{stmt: `DELETE FROM %s WHERE exp <= ?`, args: []any{now(s.Now).UnixNano()}},
+		{stmt: `DELETE FROM %s WHERE canceled = 1`},
+	} {
+		res, err := s.DB.ExecContext(ctx, s.query(q.stmt), q.args...)
+		if err != nil {
+			return int(total), errors.Wrap(err, "purging sessions")
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return int(total), errors.Wrap(err, "counting purged sessions")
+		}
+		total += n
+	}
+	return int(total), nil
+}
+
+// sqlQuerier is the subset of the methods of [*sql.DB] and [*sql.Tx] used by [SQLSessionStore].
+type sqlQuerier interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}
+
+func (s *SQLSessionStore) insert(ctx context.Context, q sqlQuerier, key string, sess *BasicSession) error {
+	data, err := sqlSessionData(sess)
+	if err != nil {
+		return err
+	}
+	var canceled int64
+	if sess.canceled {
+		canceled = 1
+	}
+	_, err = q.ExecContext(
+		ctx,
+		s.query(`INSERT INTO %s (id, csrf_key, created, exp, canceled, data) VALUES (?, ?, ?, ?, ?, ?)`),
+		hashSessionKey(key),
+		hex.EncodeToString(sess.csrfKey[:]),
+		sess.created.UnixNano(),
+		sess.exp.UnixNano(),
+		canceled,
+		data,
+	)
+	return errors.Wrap(err, "inserting session")
+}
+
+// resolve finds the unexpired session for a key,
+// following the alias for a rotated session's old key.
+// It returns the session's current key and the session,
+// plus, if key is such an old key,
+// the session's CSRF key from before rotation.
+func (s *SQLSessionStore) resolve(ctx context.Context, q sqlQuerier, key string) (string, *BasicSession, []byte, error) {
+	sess, alias, err := s.get(ctx, q, key)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if alias == nil {
+		return key, sess, nil, nil
+	}
+	if key, err = unmaskSessionKey(key, alias.masked); err != nil {
+		return "", nil, nil, err
+	}
+	sess, next, err := s.get(ctx, q, key)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if next != nil {
+		return "", nil, nil, ErrNoSession
+	}
+	return key, sess, alias.csrfKey, nil
+}
+
+// sqlSessionAlias is the content of the row for a rotated session's old key.
+type sqlSessionAlias struct {
+	masked  []byte // the masked new key
+	csrfKey []byte // the CSRF key from before rotation, if known
+}
+
+// get gets the unexpired row for a key.
+// It returns either the session stored there,
+// or the alias for the old key of a rotated session.
+func (s *SQLSessionStore) get(ctx context.Context, q sqlQuerier, key string) (*BasicSession, *sqlSessionAlias, error) {
+	var (
+		csrfKey          string
+		created, exp     int64
+		canceled         int64
+		data, aliasField sql.NullString
+	)
+	err := q.QueryRowContext(ctx, s.query(`SELECT csrf_key, created, exp, canceled, data, alias FROM %s WHERE id = ?`), hashSessionKey(key)).
+		Scan(&csrfKey, &created, &exp, &canceled, &data, &aliasField)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrNoSession
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "getting session")
+	}
+
+	if !now(s.Now).Before(time.Unix(0, exp)) {
+		return nil, nil, ErrNoSession
+	}
+
+	k, err := hex.DecodeString(csrfKey)
+	if err != nil {
+		return nil, nil, errors.New("malformed CSRF key")
+	}
+
+	if aliasField.Valid {
+		masked, err := hex.DecodeString(aliasField.String)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "decoding session alias")
+		}
+		return nil, &sqlSessionAlias{masked: masked, csrfKey: k}, nil
+	}
+
+	sess := &BasicSession{
+		created:  time.Unix(0, created),
+		exp:      time.Unix(0, exp),
+		canceled: canceled != 0,
+	}
+	if len(k) != len(sess.csrfKey) {
+		return nil, nil, errors.New("malformed CSRF key")
+	}
+	copy(sess.csrfKey[:], k)
+	if data.Valid {
+		if err := json.Unmarshal([]byte(data.String), &sess.data); err != nil {
+			return nil, nil, errors.Wrap(err, "decoding session data")
+		}
+	}
+	return sess, nil, nil
+}
+
+// sqlSessionData is the value for the data column of a session.
+func sqlSessionData(sess *BasicSession) (any, error) {
+	if len(sess.data) == 0 {
+		return nil, nil
+	}
+	j, err := json.Marshal(sess.data)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding session data")
+	}
+	return string(j), nil
+}
+
+func (s *SQLSessionStore) table() string {
+	if s.Table == "" {
+		return "sessions"
+	}
+	return s.Table
+}
+
+// query substitutes the table name into a query and binds its placeholders.
+func (s *SQLSessionStore) query(q string) string {
+	return s.bind(fmt.Sprintf(q, s.table()))
+}
+
+// bind replaces the ? placeholders in a query with the dialect's own.
+func (s *SQLSessionStore) bind(q string) string {
+	if s.Placeholder == nil {
+		return q
+	}
+	var (
+		buf strings.Builder
+		n   int
+	)
+	for _, r := range q {
+		if r == '?' {
+			n++
+			buf.WriteString(s.Placeholder(n))
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
@@ -0,0 +1,363 @@
+package mid
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSQLSessionStore(t *testing.T) {
+	for _, dollar := range []bool{false, true} {
+		t.Run(map[bool]string{false: "question", true: "dollar"}[dollar], func(t *testing.T) {
+			var (
+				ctx   = context.Background()
+				fdb   = &fakeSQLDB{dollar: dollar}
+				db    = sql.OpenDB(fdb)
+				clock = &fakeClock{t: time.Unix(1000000, 0)}
+				store = &SQLSessionStore{DB: db, Now: clock.Now}
+			)
+			defer db.Close()
+			if dollar {
+				store.Placeholder = DollarPlaceholder
+			}
+
+			if _, _, err := store.Create(ctx, clock.Now().Add(time.Hour)); err == nil {
+				t.Fatal("got no error before migrating")
+			}
+			var locked, unlocked int
+			store.MigrateLock = func(context.Context, *sql.Conn) (func() error, error) {
+				locked++
+				return func() error { unlocked++; return nil }, nil
+			}
+			for i := 0; i < 2; i++ {
+				if err := store.Migrate(ctx); err != nil {
+					t.Fatalf("migration %d: %s", i+1, err)
+				}
+			}
+			if locked != 2 || unlocked != 2 {
+				t.Errorf("got %d locks and %d unlocks, want 2 and 2", locked, unlocked)
+			}
+			unlockErr := errors.New("unlock failed")
+			store.MigrateLock = func(context.Context, *sql.Conn) (func() error, error) {
+				return func() error { return unlockErr }, nil
+			}
+			if err := store.Migrate(ctx); !errors.Is(err, unlockErr) {
+				t.Errorf("got error %v, want %v", err, unlockErr)
+			}
+
+			key1, s1, err := store.Create(ctx, clock.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			key2, _, err := store.Create(ctx, clock.Now().Add(2*time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s1.(DataSession).Set("user", "alice"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Save(ctx, key1, s1); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := store.Get(ctx, key1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.CSRFKey() != s1.CSRFKey() || !got.Exp().Equal(s1.Exp()) || !got.Active() {
+				t.Errorf("got session %+v, want %+v", got, s1)
+			}
+			if user, _, err := SessionValue[string](got.(DataSession), "user"); err != nil || user != "alice" {
+				t.Errorf("got user %q (error %v), want alice", user, err)
+			}
+			if _, err := store.Get(ctx, "bogus"); !errors.Is(err, ErrNoSession) {
+				t.Errorf("got error %v, want %v", err, ErrNoSession)
+			}
+
+			if err := store.Cancel(ctx, key2); err != nil {
+				t.Fatal(err)
+			}
+			if got, err = store.Get(ctx, key2); err != nil {
+				t.Fatal(err)
+			}
+			if got.Active() {
+				t.Error("canceled session is active")
+			}
+
+			newKey, s3, err := store.Rotate(ctx, key1, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s3.CSRFKey() == s1.CSRFKey() {
+				t.Error("CSRF key did not change")
+			}
+			if got, err = store.Get(ctx, key1); err != nil {
+				t.Fatal(err)
+			}
+			if got.CSRFKey() != s1.CSRFKey() {
+				t.Error("old key does not have the old CSRF key")
+			}
+			key, _, err := store.Renew(ctx, key1, clock.Now().Add(3*time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != newKey {
+				t.Error("renewing with the old key did not return the new key")
+			}
+			if got, err = store.Get(ctx, newKey); err != nil {
+				t.Fatal(err)
+			}
+			if user, _, err := SessionValue[string](got.(DataSession), "user"); err != nil || user != "alice" {
+				t.Errorf("got user %q (error %v) after rotation, want alice", user, err)
+			}
+
+			clock.advance(90 * time.Minute)
+			if _, err := store.Get(ctx, key1); !errors.Is(err, ErrNoSession) {
+				t.Errorf("got error %v for old key after grace period, want %v", err, ErrNoSession)
+			}
+
+			// The old key's alias and the canceled session are purged.
+			if n, err := store.Purge(ctx); err != nil || n != 2 {
+				t.Errorf("got %d, %v from Purge, want 2, nil", n, err)
+			}
+			if _, err := store.Get(ctx, newKey); err != nil {
+				t.Errorf("got error %v for new key", err)
+			}
+		})
+	}
+}
+
+// fakeSQLDB is an in-memory database/sql driver
+// that understands just the statements issued by SQLSessionStore.
+type fakeSQLDB struct {
+	dollar bool // expect $n placeholders instead of ?
+
+	mu      sync.Mutex
+	version []int64 // nil if the version table does not exist
+	rows    map[string]fakeSQLRow
+}
+
+type fakeSQLRow struct {
+	csrfKey      string
+	created, exp int64
+	canceled     int64
+	data, alias  driver.Value
+}
+
+var (
+	_ driver.Connector = &fakeSQLDB{}
+	_ driver.Driver    = &fakeSQLDB{}
+)
+
+func (db *fakeSQLDB) Connect(context.Context) (driver.Conn, error) { return fakeSQLConn{db: db}, nil }
+func (db *fakeSQLDB) Driver() driver.Driver                        { return db }
+func (db *fakeSQLDB) Open(string) (driver.Conn, error)             { return fakeSQLConn{db: db}, nil }
+
+type fakeSQLConn struct {
+	db *fakeSQLDB
+}
+
+func (c fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeSQLStmt{db: c.db, query: query}, nil
+}
+
+func (fakeSQLConn) Close() error { return nil }
+
+func (c fakeSQLConn) Begin() (driver.Tx, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	return &fakeSQLTx{db: c.db, version: slices.Clone(c.db.version), rows: maps.Clone(c.db.rows)}, nil
+}
+
+// fakeSQLTx restores a snapshot of the database on rollback.
+type fakeSQLTx struct {
+	db      *fakeSQLDB
+	version []int64
+	rows    map[string]fakeSQLRow
+}
+
+func (*fakeSQLTx) Commit() error { return nil }
+
+func (tx *fakeSQLTx) Rollback() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	tx.db.version, tx.db.rows = tx.version, tx.rows
+	return nil
+}
+
+type fakeSQLStmt struct {
+	db    *fakeSQLDB
+	query string
+}
+
+func (fakeSQLStmt) Close() error  { return nil }
+func (fakeSQLStmt) NumInput() int { return -1 }
+
+func (s fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	_, n, err := s.db.exec(s.query, args)
+	return driver.RowsAffected(n), err
+}
+
+func (s fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, _, err := s.db.exec(s.query, args)
+	return rows, err
+}
+
+var dollarRegex = regexp.MustCompile(`\$\d+`)
+
+func (db *fakeSQLDB) exec(query string, args []driver.Value) (*fakeSQLRows, int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.dollar {
+		if strings.Contains(query, "?") {
+			return nil, 0, fmt.Errorf("unexpected ? placeholder in %s", query)
+		}
+		query = dollarRegex.ReplaceAllString(query, "?")
+	} else if dollarRegex.MatchString(query) {
+		return nil, 0, fmt.Errorf("unexpected $ placeholder in %s", query)
+	}
+
+	if strings.Contains(query, "sessions_version") {
+		switch {
+		case strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS "):
+			if db.version == nil {
+				db.version = []int64{}
+			}
+			return nil, 0, nil
+		case db.version == nil:
+			return nil, 0, errors.New("no such table: sessions_version")
+		case strings.HasPrefix(query, "SELECT version FROM "):
+			rows := &fakeSQLRows{cols: []string{"version"}}
+			for _, v := range db.version {
+				rows.vals = append(rows.vals, []driver.Value{v})
+			}
+			return rows, 0, nil
+		case strings.HasPrefix(query, "INSERT INTO "):
+			db.version = append(db.version, args[0].(int64))
+			return nil, 1, nil
+		case strings.HasPrefix(query, "UPDATE "):
+			for i := range db.version {
+				db.version[i] = args[0].(int64)
+			}
+			return nil, int64(len(db.version)), nil
+		}
+		return nil, 0, fmt.Errorf("unknown statement %s", query)
+	}
+
+	if strings.HasPrefix(query, "CREATE TABLE sessions ") {
+		if db.rows != nil {
+			return nil, 0, errors.New("table sessions already exists")
+		}
+		db.rows = make(map[string]fakeSQLRow)
+		return nil, 0, nil
+	}
+	if db.rows == nil {
+		return nil, 0, errors.New("no such table: sessions")
+	}
+
+	switch query {
+	case "CREATE INDEX sessions_exp ON sessions (exp)", "CREATE INDEX sessions_canceled ON sessions (canceled)":
+		return nil, 0, nil
+
+	case "INSERT INTO sessions (id, csrf_key, created, exp, canceled, data) VALUES (?, ?, ?, ?, ?, ?)":
+		id := args[0].(string)
+		if _, ok := db.rows[id]; ok {
+			return nil, 0, errors.New("duplicate key")
+		}
+		db.rows[id] = fakeSQLRow{
+			csrfKey:  args[1].(string),
+			created:  args[2].(int64),
+			exp:      args[3].(int64),
+			canceled: args[4].(int64),
+			data:     args[5],
+		}
+		return nil, 1, nil
+
+	case "SELECT csrf_key, created, exp, canceled, data, alias FROM sessions WHERE id = ?":
+		rows := &fakeSQLRows{cols: []string{"csrf_key", "created", "exp", "canceled", "data", "alias"}}
+		if r, ok := db.rows[args[0].(string)]; ok {
+			rows.vals = append(rows.vals, []driver.Value{r.csrfKey, r.created, r.exp, r.canceled, r.data, r.alias})
+		}
+		return rows, 0, nil
+
+	case "UPDATE sessions SET canceled = 1 WHERE id = ?":
+		return nil, db.update(args[0], func(r *fakeSQLRow) { r.canceled = 1 }), nil
+
+	case "UPDATE sessions SET exp = ? WHERE id = ?":
+		return nil, db.update(args[1], func(r *fakeSQLRow) { r.exp = args[0].(int64) }), nil
+
+	case "UPDATE sessions SET data = ? WHERE id = ?":
+		return nil, db.update(args[1], func(r *fakeSQLRow) { r.data = args[0] }), nil
+
+	case "UPDATE sessions SET data = NULL, exp = ?, alias = ? WHERE id = ?":
+		return nil, db.update(args[2], func(r *fakeSQLRow) {
+			r.data, r.exp, r.alias = nil, args[0].(int64), args[1]
+		}), nil
+
+	case "DELETE FROM sessions WHERE id = ?":
+		if _, ok := db.rows[args[0].(string)]; !ok {
+			return nil, 0, nil
+		}
+		delete(db.rows, args[0].(string))
+		return nil, 1, nil
+
+	case "DELETE FROM sessions WHERE exp <= ?":
+		return nil, db.deleteWhere(func(r fakeSQLRow) bool { return r.exp <= args[0].(int64) }), nil
+
+	case "DELETE FROM sessions WHERE canceled = 1":
+		return nil, db.deleteWhere(func(r fakeSQLRow) bool { return r.canceled == 1 }), nil
+	}
+
+	return nil, 0, fmt.Errorf("unknown statement %s", query)
+}
+
+func (db *fakeSQLDB) update(id driver.Value, f func(*fakeSQLRow)) int64 {
+	r, ok := db.rows[id.(string)]
+	if !ok {
+		return 0
+	}
+	f(&r)
+	db.rows[id.(string)] = r
+	return 1
+}
+
+func (db *fakeSQLDB) deleteWhere(f func(fakeSQLRow) bool) int64 {
+	var n int64
+	for id, r := range db.rows {
+		if f(r) {
+			delete(db.rows, id)
+			n++
+		}
+	}
+	return n
+}
+
+type fakeSQLRows struct {
+	cols []string
+	vals [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string { return r.cols }
+func (r *fakeSQLRows) Close() error      { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.vals) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.vals[0])
+	r.vals = r.vals[1:]
+	return nil
+}
@@ -0,0 +1,169 @@
+package mid
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Timeout is an [http.Handler] middleware wrapper
+// that cancels the request context after the duration d,
+// with [context.DeadlineExceeded] as the cause (see [context.Cause]).
+// The context's Deadline method reports the time of cancellation,
+// so the handler can propagate it (e.g. with [DeadlineTransport]).
+// If the handler has not yet committed a status code by then,
+// the request is answered with r,
+// or with 503 Service Unavailable if r is nil
+// (via a [CodeErr] wrapping [context.DeadlineExceeded]),
+// and any later writes by the abandoned handler fail with [http.ErrHandlerTimeout].
+// If the handler has already committed a status code,
+// Timeout waits for it to finish.
+//
+// Unlike [http.TimeoutHandler],
+// Timeout does not buffer the response,
+// and the [http.ResponseWriter] it passes to the handler implements [http.Flusher].
+// Header fields set by the handler are sent only when it commits a status code.
+func Timeout(d time.Duration, r Responder, next http.Handler) http.Handler {
+	if r == nil {
+		r = CodeErr{C: http.StatusServiceUnavailable, Err: context.DeadlineExceeded}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// The context is canceled only after the timeoutWriter is marked as timed out,
+		// so that a handler reacting to cancellation cannot commit a response first.
+		cctx, cancel := context.WithCancelCause(req.Context())
+		defer cancel(nil)
+
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+
+		ctx := deadlineContext{Context: cctx, deadline: time.Now().Add(d)}
+
+		var (
+			tw     = &timeoutWriter{ww: ResponseWrapper{W: w}, h: make(http.Header)}
+			done   = make(chan struct{})
+			panicc = make(chan any, 1)
+		)
+
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicc <- p
+					return
+				}
+				close(done)
+			}()
+			next.ServeHTTP(tw, req.WithContext(ctx))
+		}()
+
+		select {
+		case p := <-panicc:
+			panic(p)
+
+		case <-done:
+			return
+
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+
+		tw.mu.Lock()
+		committed := tw.ww.Code != 0
+		tw.timedOut = !committed
+		tw.mu.Unlock()
+		cancel(context.DeadlineExceeded)
+
+		if committed {
+			select {
+			case p := <-panicc:
+				panic(p)
+			case <-done:
+			}
+			return
+		}
+
+		r.Respond(w)
+	})
+}
+
+// deadlineContext reports a deadline
+// for a context that is canceled by other means.
+type deadlineContext struct {
+	context.Context
+	deadline time.Time
+}
+
+func (dc deadlineContext) Deadline() (time.Time, bool) {
+	if parent, ok := dc.Context.Deadline(); ok && parent.Before(dc.deadline) {
+		return parent, true
+	}
+	return dc.deadline, true
+}
+
+// timeoutWriter is the http.ResponseWriter passed to the handler wrapped by Timeout.
+// It gives the handler a private header
+// and stops passing writes through once the request has timed out.
+type timeoutWriter struct {
+	h http.Header // accessed only by the handler's goroutine
+
+	mu       sync.Mutex
+	ww       ResponseWrapper
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return
+	}
+	tw.writeHeader(code)
+}
+
+// writeHeader copies the handler's header to the underlying ResponseWriter
+// and commits the status code.
+// Callers must hold tw.mu.
+func (tw *timeoutWriter) writeHeader(code int) {
+	if tw.ww.Code == 0 {
+		dst := tw.ww.Header()
+		for k, v := range tw.h {
+			dst[k] = v
+		}
+	}
+	tw.ww.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.ww.Code == 0 {
+		tw.writeHeader(http.StatusOK)
+	}
+	return tw.ww.Write(b)
+}
+
+// Flush implements http.Flusher.
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return
+	}
+	if tw.ww.Code == 0 {
+		tw.writeHeader(http.StatusOK)
+	}
+	if f, ok := tw.ww.W.(http.Flusher); ok {
+		f.Flush()
+	}
+}
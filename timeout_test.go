@@ -0,0 +1,108 @@
+package mid
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeout(t *testing.T) {
+	lateWrite := make(chan error, 1)
+
+	cases := []struct {
+		name       string
+		r          Responder
+		handler    http.HandlerFunc
+		wantStatus int
+		wantBody   string
+		wantHeader string
+	}{{
+		name: "fast",
+		handler: func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("X-Test", "fast")
+			w.Write([]byte("ok"))
+		},
+		wantStatus: http.StatusOK,
+		wantBody:   "ok",
+		wantHeader: "fast",
+	}, {
+		name: "slow",
+		handler: func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("X-Test", "slow")
+			<-req.Context().Done()
+			_, err := w.Write([]byte("too late"))
+			lateWrite <- err
+		},
+		wantStatus: http.StatusServiceUnavailable,
+	}, {
+		name: "custom_responder",
+		r:    CodeErr{C: http.StatusGatewayTimeout},
+		handler: func(_ http.ResponseWriter, req *http.Request) {
+			<-req.Context().Done()
+		},
+		wantStatus: http.StatusGatewayTimeout,
+	}, {
+		name: "committed",
+		handler: func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+			w.(http.Flusher).Flush()
+			<-req.Context().Done()
+			w.Write([]byte("done"))
+		},
+		wantStatus: http.StatusAccepted,
+		wantBody:   "done",
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := Timeout(20*time.Millisecond, tc.r, tc.handler)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tc.wantStatus)
+			}
+			if tc.wantBody != "" && rec.Body.String() != tc.wantBody {
+				t.Errorf("got body %q, want %q", rec.Body.String(), tc.wantBody)
+			}
+			if got := rec.Header().Get("X-Test"); got != tc.wantHeader {
+				t.Errorf("got X-Test %q, want %q", got, tc.wantHeader)
+			}
+		})
+	}
+
+	if err := <-lateWrite; !errors.Is(err, http.ErrHandlerTimeout) {
+		t.Errorf("got late write error %v, want %v", err, http.ErrHandlerTimeout)
+	}
+}
+
+func TestTimeoutDeadline(t *testing.T) {
+	var (
+		deadline time.Time
+		ok       bool
+	)
+	h := Timeout(time.Minute, nil, http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		deadline, ok = req.Context().Deadline()
+	}))
+	start := time.Now()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if !ok {
+		t.Fatal("handler's context has no deadline")
+	}
+	if deadline.Before(start.Add(time.Minute)) || deadline.After(time.Now().Add(time.Minute)) {
+		t.Errorf("got deadline %s after start, want 1m", deadline.Sub(start))
+	}
+
+	// An earlier deadline of the parent context prevails.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	parent, _ := ctx.Deadline()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	if !deadline.Equal(parent) {
+		t.Errorf("got deadline %s, want %s", deadline, parent)
+	}
+}